@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"time"
+)
+
+// reACRRegistry matches the host names of Azure Container Registry
+// in the public and the sovereign clouds. The submatch is the domain
+// suffix that identifies the cloud.
+var reACRRegistry = regexp.MustCompile(`\.azurecr\.(io|cn|us)$`)
+
+// azureCloud holds the endpoints of an Azure cloud: the Azure AD
+// authority and the audience of the tokens that ACR accepts for the
+// exchange.
+type azureCloud struct {
+	authority string
+	resource  string
+}
+
+// azureClouds maps the ACR domain suffixes to the respective clouds.
+var azureClouds = map[string]azureCloud{
+	"io": {"https://login.microsoftonline.com/",
+		"https://management.azure.com/"},
+	"cn": {"https://login.chinacloudapi.cn/",
+		"https://management.chinacloudapi.cn/"},
+	"us": {"https://login.microsoftonline.us/",
+		"https://management.usgovcloudapi.net/"},
+}
+
+// acrRegistry returns the host name of the registry of the image if it
+// is an Azure Container Registry, or an empty string otherwise.
+func acrRegistry(imageName string, opts *options) string {
+	registry := imageRegistry(imageName, opts)
+	if !reACRRegistry.MatchString(registry) {
+		return ""
+	}
+	return registry
+}
+
+// acrTokenUser is the user name that goes with ACR refresh tokens.
+const acrTokenUser = "00000000-0000-0000-0000-000000000000"
+
+// decodeToken reads the named token field from the JSON response.
+func decodeToken(resp *http.Response, field string) (string, error) {
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("'%s': %s", resp.Request.URL.Host,
+			resp.Status)
+	}
+
+	var body map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	token, _ := body[field].(string)
+	if token == "" {
+		return "", fmt.Errorf("'%s' returned no %s",
+			resp.Request.URL.Host, field)
+	}
+	return token, nil
+}
+
+// azureADToken obtains an Azure AD access token for the service principal
+// given in the AZURE_CLIENT_ID, AZURE_CLIENT_SECRET, and AZURE_TENANT_ID
+// environment variables or, without a client secret, for the managed
+// identity of the machine (the user-assigned one if AZURE_CLIENT_ID is
+// set). The token is issued by the authority of the given cloud. The
+// tenant is returned along with the token if it is known.
+func azureADToken(cloud azureCloud) (string, string, error) {
+	clientID := os.Getenv("AZURE_CLIENT_ID")
+	tenant := os.Getenv("AZURE_TENANT_ID")
+
+	if secret := os.Getenv("AZURE_CLIENT_SECRET"); secret != "" {
+		if clientID == "" || tenant == "" {
+			return "", "", errors.New("AZURE_CLIENT_SECRET requires " +
+				"AZURE_CLIENT_ID and AZURE_TENANT_ID")
+		}
+		resp, err := http.PostForm(cloud.authority+
+			url.PathEscape(tenant)+"/oauth2/v2.0/token", url.Values{
+			"grant_type":    {"client_credentials"},
+			"client_id":     {clientID},
+			"client_secret": {secret},
+			"scope":         {cloud.resource + ".default"},
+		})
+		if err != nil {
+			return "", "", err
+		}
+		token, err := decodeToken(resp, "access_token")
+		return token, tenant, err
+	}
+
+	query := url.Values{
+		"api-version": {"2018-02-01"},
+		"resource":    {cloud.resource},
+	}
+	if clientID != "" {
+		query.Set("client_id", clientID)
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://169.254.169.254"+
+		"/metadata/identity/oauth2/token?"+query.Encode(), nil)
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Metadata", "true")
+
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", fmt.Errorf("managed identity: %v", err)
+	}
+	token, err := decodeToken(resp, "access_token")
+	return token, tenant, err
+}
+
+// acrCredentials exchanges an Azure AD access token for an ACR refresh
+// token, which the registry accepts as the password of a special user
+// both in the API requests and in 'docker login'. The token is only sent
+// to that registry. The Azure AD endpoints are those of the cloud that
+// the registry belongs to.
+func acrCredentials(registry string) (*registryCredentials, error) {
+	match := reACRRegistry.FindStringSubmatch(registry)
+	if match == nil {
+		return nil, fmt.Errorf("'%s' is not an Azure Container "+
+			"Registry", registry)
+	}
+
+	aadToken, tenant, err := azureADToken(azureClouds[match[1]])
+	if err != nil {
+		return nil, fmt.Errorf("unable to obtain an Azure AD token: %v",
+			err)
+	}
+
+	form := url.Values{
+		"grant_type":   {"access_token"},
+		"service":      {registry},
+		"access_token": {aadToken},
+	}
+	if tenant != "" {
+		form.Set("tenant", tenant)
+	}
+	resp, err := http.PostForm("https://"+registry+"/oauth2/exchange", form)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := decodeToken(resp, "refresh_token")
+	if err != nil {
+		return nil, fmt.Errorf("unable to obtain an ACR token for %s: %v",
+			registry, err)
+	}
+
+	return &registryCredentials{registry: registry, user: acrTokenUser,
+		password: refreshToken}, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+type inTotoSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type decisionPredicate struct {
+	Timestamp time.Time      `json:"timestamp"`
+	Images    []decisionInfo `json:"images"`
+}
+
+type decisionInfo struct {
+	Image             string `json:"image"`
+	Fingerprint       string `json:"fingerprint"`
+	FingerprintSource string `json:"fingerprintSource"`
+	Decision          string `json:"decision"`
+	Reason            string `json:"reason"`
+}
+
+type inTotoStatement struct {
+	Type          string            `json:"_type"`
+	Subject       []inTotoSubject   `json:"subject"`
+	PredicateType string            `json:"predicateType"`
+	Predicate     decisionPredicate `json:"predicate"`
+}
+
+// repositoryName strips the tag from an image reference.
+func repositoryName(imageName string) string {
+	if i := strings.LastIndexByte(imageName, ':'); i >
+		strings.LastIndexByte(imageName, '/') {
+		return imageName[:i]
+	}
+	return imageName
+}
+
+// decisionReason explains why the image was reused or built. A forced
+// rebuild and a fingerprint supplied with '-fingerprint', which says
+// nothing about the sources, are stated as such.
+func decisionReason(result *imageResult) string {
+	fingerprint := "fingerprint " + result.Fingerprint
+	if result.FingerprintSource == "external" {
+		fingerprint = "externally supplied " + fingerprint
+	} else {
+		fingerprint = "computed " + fingerprint
+	}
+
+	switch {
+	case result.Decision == "reused":
+		return fmt.Sprintf("reused digest %s because an image with "+
+			"the %s existed", result.Digest, fingerprint)
+	case result.ForcedRebuild:
+		return fmt.Sprintf("built digest %s with the %s because "+
+			"-force-rebuild was given", result.Digest, fingerprint)
+	}
+	return fmt.Sprintf("built digest %s because no reusable image "+
+		"with the %s existed", result.Digest, fingerprint)
+}
+
+// writeDecisionAttestation writes an in-toto statement recording why
+// each image was reused or built and signs it using cosign, which obtains
+// a Fulcio certificate for the ambient OIDC identity. The signature bundle
+// is saved next to the statement with the '.bundle' suffix.
+func writeDecisionAttestation(filename string,
+	results []*imageResult) error {
+
+	cosign, err := exec.LookPath("cosign")
+	if err != nil {
+		return fmt.Errorf("cosign is required to sign "+
+			"the decision attestation: %v", err)
+	}
+
+	statement := inTotoStatement{
+		Type:          "https://in-toto.io/Statement/v0.1",
+		PredicateType: "https://github.com/revl/docker-reuse/decision/v1",
+		Predicate: decisionPredicate{
+			Timestamp: time.Now().UTC(),
+		},
+	}
+
+	for _, result := range results {
+		digest := strings.TrimPrefix(result.Digest, "sha256:")
+		statement.Subject = append(statement.Subject, inTotoSubject{
+			Name:   repositoryName(result.Image),
+			Digest: map[string]string{"sha256": digest},
+		})
+
+		info := decisionInfo{
+			Image:             result.Image,
+			Fingerprint:       result.Fingerprint,
+			FingerprintSource: result.FingerprintSource,
+			Decision:          result.Decision,
+		}
+		info.Reason = decisionReason(result)
+		statement.Predicate.Images = append(
+			statement.Predicate.Images, info)
+	}
+
+	contents, err := json.MarshalIndent(statement, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err = ioutil.WriteFile(filename,
+		append(contents, '\n'), 0644); err != nil {
+		return err
+	}
+
+	cmd := exec.Command(cosign, "sign-blob", "--yes",
+		"--bundle", filename+".bundle", filename)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+)
+
+// imageResult describes the outcome of the find-or-build flow
+// for a single image.
+type imageResult struct {
+	Image       string `json:"image"`
+	Fingerprint string `json:"fingerprint"`
+	// FingerprintSource is "external" if the fingerprint was given
+	// with '-fingerprint', or "computed" otherwise.
+	FingerprintSource string `json:"fingerprintSource"`
+	// Decision is either "reused" or "built".
+	Decision string `json:"decision"`
+	// ForcedRebuild tells that the image was built because of
+	// '-force-rebuild', regardless of whether it already existed.
+	ForcedRebuild bool   `json:"forcedRebuild,omitempty"`
+	Digest        string `json:"digest,omitempty"`
+	// FingerprintSeconds is the time it took to compute the fingerprint
+	// and BytesHashed is the amount of data hashed in the process.
+	FingerprintSeconds float64 `json:"fingerprintSeconds,omitempty"`
+	BytesHashed        int64   `json:"bytesHashed,omitempty"`
+	// BuildSeconds is the time it took to build and push the image.
+	BuildSeconds float64 `json:"buildSeconds,omitempty"`
+	// SavedSeconds is the build time of a reused image, as recorded
+	// when it was originally built.
+	SavedSeconds float64 `json:"savedSeconds,omitempty"`
+	// UpdatedFile describes the modification of the template file,
+	// if it had to be updated.
+	UpdatedFile *fileUpdate `json:"updatedFile,omitempty"`
+}
+
+type auditRecord struct {
+	Time   time.Time      `json:"time"`
+	User   string         `json:"user,omitempty"`
+	Host   string         `json:"host,omitempty"`
+	Args   []string       `json:"args"`
+	Images []*imageResult `json:"images"`
+	Error  string         `json:"error,omitempty"`
+}
+
+// redactBuildArgs returns a copy of the command line arguments with
+// the values of the trailing build arguments replaced with a marker.
+func redactBuildArgs(args []string, buildArgCount int) []string {
+	redacted := append([]string(nil), args...)
+
+	for i := len(redacted) - buildArgCount; i < len(redacted); i++ {
+		if eq := strings.IndexByte(redacted[i], '='); eq >= 0 {
+			redacted[i] = redacted[i][:eq+1] + "<redacted>"
+		}
+	}
+
+	return redacted
+}
+
+// secretFlags are the options whose values are credentials.
+var secretFlags = map[string]bool{
+	"registry-password": true,
+	"registry-token":    true,
+}
+
+// redactURL replaces the user information of the URL, which may hold
+// credentials, with a marker.
+func redactURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+	u.User = nil
+	return u.Scheme + "://<redacted>@" +
+		strings.TrimPrefix(u.String(), u.Scheme+"://")
+}
+
+// scrubSecretFlags returns a copy of the command line arguments without
+// the credentials given in the options: the values of the secret options
+// and the user information of the proxy URL. With drop, the options that
+// hold credentials are removed along with their values; otherwise, the
+// credentials are replaced with a marker. The arguments after '--' are
+// left as they are.
+func scrubSecretFlags(args []string, drop bool) []string {
+	var scrubbed []string
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return append(scrubbed, args[i:]...)
+		}
+		if !strings.HasPrefix(arg, "-") {
+			scrubbed = append(scrubbed, arg)
+			continue
+		}
+
+		name := strings.TrimLeft(arg, "-")
+		value := ""
+		inline := false
+		if eq := strings.IndexByte(name, '='); eq >= 0 {
+			name, value, inline = name[:eq], name[eq+1:], true
+		}
+		if !secretFlags[name] && name != "proxy" {
+			scrubbed = append(scrubbed, arg)
+			continue
+		}
+
+		start := i
+		if !inline && i+1 < len(args) {
+			i++
+			value = args[i]
+		}
+
+		if secretFlags[name] {
+			value = "<redacted>"
+		} else if redacted := redactURL(value); redacted != value {
+			value = redacted
+		} else {
+			scrubbed = append(scrubbed, args[start:i+1]...)
+			continue
+		}
+
+		if !drop {
+			scrubbed = append(scrubbed, "-"+name+"="+value)
+		}
+	}
+
+	return scrubbed
+}
+
+// appendAuditRecord appends a single line describing the run
+// to the audit log file in the JSON Lines format.
+func appendAuditRecord(filename string, args []string,
+	results []*imageResult, runErr error) error {
+
+	record := auditRecord{
+		Time:   time.Now().UTC(),
+		Args:   args,
+		Images: results,
+	}
+
+	if u, err := user.Current(); err == nil {
+		record.User = u.Username
+	}
+	record.Host, _ = os.Hostname()
+
+	if runErr != nil {
+		record.Error = runErr.Error()
+	}
+
+	if record.Images == nil {
+		record.Images = []*imageResult{}
+	}
+
+	var line bytes.Buffer
+	encoder := json.NewEncoder(&line)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(record); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filename,
+		os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(line.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
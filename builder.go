@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// buildTool is the command that builds, tags, and pushes the images,
+// selected with '-builder'.
+var buildTool = "docker"
+
+// checkBuilder validates the value of the '-builder' option.
+func checkBuilder(tool string) error {
+	switch tool {
+	case "docker", "podman", "buildah", "nerdctl":
+		return nil
+	}
+	return errors.New("-builder must be one of " +
+		"'docker', 'podman', 'buildah', or 'nerdctl'")
+}
+
+// builderArgs translates the arguments of a docker command to those of
+// the build tool. Podman and nerdctl accept the docker commands that are
+// used as is; buildah has no 'image' command and names the image ID
+// differently.
+func builderArgs(arg []string) []string {
+	if buildTool != "buildah" || len(arg) < 2 ||
+		arg[0] != "image" || arg[1] != "inspect" {
+		return arg
+	}
+
+	translated := []string{"inspect", "--type", "image"}
+	for _, a := range arg[2:] {
+		if a == "{{.Id}}" {
+			a = "{{.FromImageID}}"
+		}
+		translated = append(translated, a)
+	}
+	return translated
+}
+
+// getImageDigest returns the digest of the image manifest (or manifest
+// list) stored in the registry. The registry API is used with all the
+// build tools, so that no 'docker buildx' is required.
+func getImageDigest(imageName string, opts *options) (string, error) {
+	ref, err := parseReference(imageName, opts)
+	if err != nil {
+		return "", err
+	}
+
+	var digest string
+	err = withRetries(opts, "inspecting "+imageName, func() error {
+		desc, err := remote.Head(ref, registryOptions(opts)...)
+		if err != nil {
+			return err
+		}
+		digest = desc.Digest.String()
+		return nil
+	})
+	return digest, err
+}
+
+// platformKey returns the platform in the 'os/arch[/variant]' form.
+func platformKey(platform *v1.Platform) string {
+	key := platform.OS + "/" + platform.Architecture
+	if platform.Variant != "" {
+		key += "/" + platform.Variant
+	}
+	return key
+}
+
+// registryImageConfig returns the configuration of the image. For
+// multi-platform images, the configuration of the first platform is
+// returned, the same as in getImageLabels.
+func registryImageConfig(ref name.Reference,
+	opts *options) (*v1.ConfigFile, error) {
+
+	desc, err := remote.Get(ref, registryOptions(opts)...)
+	if err != nil {
+		return nil, err
+	}
+	if !desc.MediaType.IsIndex() {
+		image, err := desc.Image()
+		if err != nil {
+			return nil, err
+		}
+		return image.ConfigFile()
+	}
+
+	index, err := desc.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	digests := make(map[string]v1.Hash)
+	var keys []string
+	for _, m := range manifest.Manifests {
+		// Skip the attestation manifests, which have
+		// the 'unknown/unknown' platform.
+		if m.Platform == nil || m.Platform.OS == "unknown" {
+			continue
+		}
+		key := platformKey(m.Platform)
+		digests[key] = m.Digest
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("'%s' has no platform images", ref)
+	}
+	sort.Strings(keys)
+
+	image, err := index.Image(digests[keys[0]])
+	if err != nil {
+		return nil, err
+	}
+	return image.ConfigFile()
+}
+
+// registryImageLabels returns the labels of the image using the registry
+// API, for the build tools that have no equivalent of 'docker buildx
+// imagetools'.
+func registryImageLabels(imageName string,
+	opts *options) (map[string]string, error) {
+
+	ref, err := parseReference(imageName, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var labels map[string]string
+	err = withRetries(opts, "inspecting "+imageName, func() error {
+		config, err := registryImageConfig(ref, opts)
+		if err != nil {
+			return err
+		}
+		labels = config.Config.Labels
+		return nil
+	})
+	return labels, err
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// fileUpdate describes a modification of a template file.
+type fileUpdate struct {
+	Path string `json:"path"`
+	// Before and After are the SHA-256 hashes of the file contents.
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+func sha256Hex(contents []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(contents))
+}
+
+// runPostUpdateCommand runs the formatter command on the updated file.
+// The '{}' placeholders in the command are replaced with the pathname;
+// without them, the pathname is appended to the command.
+func runPostUpdateCommand(command, filename string, quiet bool) error {
+	script := strings.ReplaceAll(command, "{}", `"$1"`)
+	displayed := strings.ReplaceAll(command, "{}", filename)
+	if script == command {
+		script += ` "$1"`
+		displayed += " " + filename
+	}
+
+	cmd := exec.Command("sh", "-c", script, "sh", filename)
+	cmd.Stderr = os.Stderr
+	if !quiet {
+		cmd.Stdout = os.Stdout
+		fmt.Println("Run:", displayed)
+	}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("'%s' failed for '%s': %v",
+			command, filename, err)
+	}
+	return nil
+}
+
+// updateTemplateFile writes the new contents of the template file, runs
+// the post-update command on it, if any, and records the update in the
+// result.
+func updateTemplateFile(result *imageResult, filename string,
+	oldContents, newContents []byte, opts *options) error {
+
+	if err := ioutil.WriteFile(filename, newContents, 0); err != nil {
+		return err
+	}
+
+	if opts.postUpdate != "" {
+		if err := runPostUpdateCommand(opts.postUpdate,
+			filename, opts.quiet); err != nil {
+			return err
+		}
+
+		// The hash must reflect the formatted contents.
+		var err error
+		if newContents, err = ioutil.ReadFile(filename); err != nil {
+			return err
+		}
+	}
+
+	result.UpdatedFile = &fileUpdate{filename,
+		sha256Hex(oldContents), sha256Hex(newContents)}
+
+	if !opts.quiet {
+		fmt.Printf("Updated: %s sha256:%s -> sha256:%s\n", filename,
+			result.UpdatedFile.Before, result.UpdatedFile.After)
+	}
+
+	return nil
+}
+
+// writeChangedFiles writes the list of the template files modified by the
+// run to a JSON file. A file updated several times, for example, for more
+// than one Skaffold artifact, is listed once, with the hash before the
+// first update and the hash after the last one.
+func writeChangedFiles(filename string, results []*imageResult) error {
+	changes := []*fileUpdate{}
+	index := map[string]*fileUpdate{}
+
+	for _, result := range results {
+		update := result.UpdatedFile
+		if update == nil {
+			continue
+		}
+		if change, ok := index[update.Path]; ok {
+			change.After = update.After
+			continue
+		}
+		change := *update
+		index[update.Path] = &change
+		changes = append(changes, &change)
+	}
+
+	output, err := json.MarshalIndent(changes, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, append(output, '\n'), 0644)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// deployment returns a Kubernetes deployment that runs the image, with
+// the lines terminated by the respective line endings (the last one is
+// reused for the remaining lines).
+func deployment(image string, eols ...string) string {
+	lines := []string{
+		`# Deployed by CI`,
+		`apiVersion: apps/v1`,
+		`kind: Deployment`,
+		`metadata:`,
+		`  name: app`,
+		`spec:`,
+		`  template:`,
+		`    spec:`,
+		`      containers:`,
+		`      - name: server`,
+		`        image: ` + image,
+	}
+
+	var b strings.Builder
+	for i, line := range lines {
+		b.WriteString(line)
+		if i < len(eols) {
+			b.WriteString(eols[i])
+		} else {
+			b.WriteString(eols[len(eols)-1])
+		}
+	}
+	return b.String()
+}
+
+func TestUpdateTemplateFilePreservesLineEndings(t *testing.T) {
+	const oldImage = "registry.example.com/app:0123abcd"
+	const newImage = "registry.example.com/app:4567cdef"
+
+	dir, err := ioutil.TempDir("", "docker-reuse-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name string
+		bom  string
+		eols []string
+	}{
+		{"LF", "", []string{"\n"}},
+		{"CRLF", "", []string{"\r\n"}},
+		{"BOM and CRLF", string(utf8BOM), []string{"\r\n"}},
+		{"BOM and LF", string(utf8BOM), []string{"\n"}},
+		{"mixed LF and CRLF", "",
+			[]string{"\n", "\r\n", "\n", "\r\n", "\r\n", "\n",
+				"\r\n", "\n", "\n", "\r\n", "\n"}},
+		{"BOM and mixed LF and CRLF", string(utf8BOM),
+			[]string{"\r\n", "\n", "\r\n", "\n", "\n", "\r\n",
+				"\n", "\r\n", "\r\n", "\n", "\r\n"}},
+	}
+
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			input := test.bom + deployment(oldImage, test.eols...)
+			want := test.bom + deployment(newImage, test.eols...)
+
+			filename := filepath.Join(dir,
+				"deployment"+strconv.Itoa(i)+".yaml")
+			if err := ioutil.WriteFile(filename,
+				[]byte(input), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			placeholder, err := findPlaceholder([]byte(input),
+				filename, "registry.example.com/app", "", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(placeholder) != oldImage {
+				t.Fatalf("placeholder: got %q, want %q",
+					placeholder, oldImage)
+			}
+
+			result := &imageResult{}
+			err = updateTemplateFile(result, filename,
+				[]byte(input), bytes.ReplaceAll([]byte(input),
+					placeholder, []byte(newImage)),
+				&options{quiet: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			output, err := ioutil.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(output) != want {
+				t.Errorf("got %q, want %q", output, want)
+			}
+			if result.UpdatedFile == nil ||
+				result.UpdatedFile.After != sha256Hex(output) {
+				t.Errorf("the update of '%s' is not recorded "+
+					"correctly", filename)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+)
+
+// reportRegistryImpact prints the registry changes that building the
+// image (or copying it from another registry, unless mirrorName is empty)
+// and applying the additional tags would make. Only read-only registry
+// requests are performed.
+func reportRegistryImpact(imageName, mirrorName, fingerprint string,
+	exists bool, opts *options) error {
+
+	fmt.Println("Dry run: registry changes:")
+
+	changes := 0
+
+	newDigest := "(new build)"
+	if exists {
+		digest, err := getImageDigest(imageName, opts)
+		if err != nil {
+			return err
+		}
+		newDigest = digest
+	} else if mirrorName != "" {
+		digest, err := getImageDigest(mirrorName, opts)
+		if err != nil {
+			return err
+		}
+		newDigest = digest
+		fmt.Println("  copy manifest", mirrorName, "->", imageName)
+		changes++
+	} else {
+		fmt.Println("  build and push manifest", imageName)
+		changes++
+	}
+
+	// Copying an image reuses it.
+	reused := exists || mirrorName != ""
+
+	repository := repositoryName(imageName)
+
+	for _, tag := range opts.tags {
+		taggedName := repository + ":" + tag
+
+		if reused && opts.tagsOnReuse == "never" {
+			continue
+		}
+
+		tagExists, err := imageExists(taggedName, opts)
+		if err != nil {
+			return err
+		}
+
+		if !tagExists {
+			fmt.Println("  create tag", taggedName, "->", newDigest)
+			changes++
+			continue
+		}
+
+		if reused && opts.tagsOnReuse == "if-missing" {
+			continue
+		}
+
+		oldDigest, err := getImageDigest(taggedName, opts)
+		if err != nil {
+			return err
+		}
+
+		if oldDigest == newDigest {
+			continue
+		}
+
+		labels, err := getImageLabels(taggedName, opts)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("  move tag", taggedName+":",
+			oldDigest, "->", newDigest)
+		changes++
+
+		if oldFingerprint := labels[fingerprintLabel]; oldFingerprint !=
+			fingerprint && !opts.forceTagMove {
+			if oldFingerprint == "" {
+				oldFingerprint = "unknown"
+			}
+			fmt.Printf("    (would be refused: the tag points to "+
+				"fingerprint %s)\n", oldFingerprint)
+		}
+	}
+
+	if changes == 0 {
+		fmt.Println("  none")
+	}
+
+	return nil
+}
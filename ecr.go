@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// reECRRegistry matches the host names of Amazon ECR private registries
+// and captures the account ID and the region.
+var reECRRegistry = regexp.MustCompile(
+	`^(\d{12})\.dkr\.ecr(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?$`)
+
+// ecrRepository identifies a repository in an ECR registry.
+type ecrRepository struct {
+	registry string
+	account  string
+	region   string
+	name     string
+}
+
+// parseECRRepository returns the ECR repository of the image, or nil if
+// the image is not in an ECR registry.
+func parseECRRepository(imageName string, opts *options) *ecrRepository {
+	ref, err := parseReference(imageName, opts)
+	if err != nil {
+		return nil
+	}
+	match := reECRRegistry.FindStringSubmatch(ref.Context().RegistryStr())
+	if match == nil {
+		return nil
+	}
+	return &ecrRepository{match[0], match[1], match[2],
+		ref.Context().RepositoryStr()}
+}
+
+// ecrClient returns an ECR API client for the region of the repository.
+// The AWS credentials are taken from the default chain of the SDK: the
+// environment, the shared configuration files, or the instance role.
+func ecrClient(repo *ecrRepository) (*ecr.ECR, error) {
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            aws.Config{Region: aws.String(repo.region)},
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create an AWS session: %v",
+			err)
+	}
+	return ecr.New(sess), nil
+}
+
+// ecrCredentials obtains a temporary ECR authorization token for the
+// registry of the repository. The token is valid for 12 hours and only
+// sent to the ECR registry.
+func ecrCredentials(repo *ecrRepository) (*registryCredentials, error) {
+	client, err := ecrClient(repo)
+	if err != nil {
+		return nil, err
+	}
+	output, err := client.GetAuthorizationToken(
+		&ecr.GetAuthorizationTokenInput{
+			RegistryIds: []*string{aws.String(repo.account)},
+		})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get the ECR token: %v", err)
+	}
+	if len(output.AuthorizationData) == 0 {
+		return nil, errors.New("unable to get the ECR token: " +
+			"no authorization data returned")
+	}
+
+	// The token is the base64-encoded 'AWS:password' pair.
+	token, err := base64.StdEncoding.DecodeString(
+		aws.StringValue(output.AuthorizationData[0].AuthorizationToken))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ECR token: %v", err)
+	}
+	parts := strings.SplitN(string(token), ":", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("invalid ECR token: " +
+			"expected a user name and a password")
+	}
+	return &registryCredentials{registry: repo.registry, user: parts[0],
+		password: parts[1]}, nil
+}
+
+// ensureECRRepository checks that the ECR repository exists before the
+// first push, creating it if '-create-namespace private' is given. ECR
+// does not create repositories on push, and without this check, a missing
+// repository only shows up as a failure of the push after the build.
+func ensureECRRepository(repo *ecrRepository, opts *options) error {
+	client, err := ecrClient(repo)
+	if err != nil {
+		return err
+	}
+	_, err = client.DescribeRepositories(&ecr.DescribeRepositoriesInput{
+		RegistryId:      aws.String(repo.account),
+		RepositoryNames: []*string{aws.String(repo.name)},
+	})
+	if err == nil {
+		return nil
+	}
+	if awsErr, ok := err.(awserr.Error); !ok ||
+		awsErr.Code() != ecr.ErrCodeRepositoryNotFoundException {
+		return fmt.Errorf("unable to check if the ECR repository "+
+			"'%s' exists: %v", repo.name, err)
+	}
+
+	switch opts.visibility {
+	case "":
+		return fmt.Errorf("the ECR repository '%s' does not exist; "+
+			"use -create-namespace private to create it", repo.name)
+	case "public":
+		return errors.New("ECR private registries cannot " +
+			"have public repositories")
+	}
+
+	if _, err = client.CreateRepository(&ecr.CreateRepositoryInput{
+		RegistryId:     aws.String(repo.account),
+		RepositoryName: aws.String(repo.name),
+	}); err != nil {
+		return fmt.Errorf("unable to create the ECR repository "+
+			"'%s': %v", repo.name, err)
+	}
+
+	if !opts.quiet {
+		fmt.Println("Created the ECR repository", repo.name)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// readEnvFile reads build arguments from a dotenv-style file. Each line
+// contains a NAME=value pair, optionally preceded by 'export'; blank lines
+// and lines starting with '#' are skipped. A value enclosed in matching
+// single or double quotes is unquoted without further processing.
+func readEnvFile(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var buildArgs []string
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if lineNumber == 1 {
+			line = strings.TrimPrefix(line, string(utf8BOM))
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		eq := strings.IndexByte(line, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("%s:%d: expected NAME=value",
+				filename, lineNumber)
+		}
+		name := strings.TrimSpace(line[:eq])
+		value := strings.TrimSpace(line[eq+1:])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') &&
+			value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+
+		buildArgs = append(buildArgs, name+"="+value)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return buildArgs, nil
+}
+
+// mergeBuildArgs combines the lists of build arguments. An argument
+// overrides the arguments with the same name that precede it, keeping
+// their position in the list.
+func mergeBuildArgs(lists ...[]string) []string {
+	var merged []string
+	index := map[string]int{}
+
+	for _, buildArgs := range lists {
+		for _, buildArg := range buildArgs {
+			name := strings.SplitN(buildArg, "=", 2)[0]
+			if i, ok := index[name]; ok {
+				merged[i] = buildArg
+				continue
+			}
+			index[name] = len(merged)
+			merged = append(merged, buildArg)
+		}
+	}
+
+	return merged
+}
+
+// readBuildArgFiles replaces the build argument values of the form @path
+// with the contents of the respective files, which makes the contents part
+// of the fingerprint. The names of these arguments are mapped to the file
+// paths in argFiles, so that the contents are passed to the build through
+// the environment rather than on the command line. A value starting with
+// '@@' stands for the literal value without the first '@'.
+func readBuildArgFiles(buildArgs []string,
+	argFiles map[string]string) ([]string, error) {
+
+	result := make([]string, len(buildArgs))
+
+	for i, buildArg := range buildArgs {
+		parts := strings.SplitN(buildArg, "=", 2)
+		if len(parts) == 2 && strings.HasPrefix(parts[1], "@@") {
+			buildArg = parts[0] + "=" + parts[1][1:]
+		} else if len(parts) == 2 && strings.HasPrefix(parts[1], "@") {
+			contents, err := ioutil.ReadFile(parts[1][1:])
+			if err != nil {
+				return nil, fmt.Errorf("unable to read the value "+
+					"of build argument '%s': %v", parts[0], err)
+			}
+			buildArg = parts[0] + "=" + string(contents)
+			argFiles[parts[0]] = parts[1][1:]
+		}
+		result[i] = buildArg
+	}
+
+	return result, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// ephemeralTag returns the tag that sets the lifetime of the image in
+// a ttl.sh-style registry, which deletes the image when the duration
+// given by the tag, such as '2h', elapses after the push.
+func ephemeralTag(ttl time.Duration) string {
+	switch {
+	case ttl%time.Hour == 0:
+		return fmt.Sprintf("%dh", ttl/time.Hour)
+	case ttl%time.Minute == 0:
+		return fmt.Sprintf("%dm", ttl/time.Minute)
+	}
+	return fmt.Sprintf("%ds", (ttl+time.Second-1)/time.Second)
+}
+
+// ephemeralImageName returns the name of the image in the '-ephemeral'
+// mode. Since the tag holds the TTL, the fingerprint is appended to the
+// repository name instead.
+func ephemeralImageName(imageName, fingerprint string,
+	ttl time.Duration) string {
+
+	return imageName + "-" + fingerprint + ":" + ephemeralTag(ttl)
+}
+
+// ephemeralRefPattern matches what follows the image name in the
+// references to ephemeral images: the fingerprint and the TTL tag, or
+// a regular tag, which the first ephemeral run replaces.
+const ephemeralRefPattern = `(?:-[-.\w]+:[-.\w]+|:[-.\w]+)?`
+
+// expiresSoon tells whether the ephemeral image has used up more than
+// half of its TTL, so that it may expire before it is deployed or while
+// it is in use. Such an image is rebuilt and pushed again, which renews
+// it, instead of being reused.
+//
+// The registry API does not tell when the image was pushed, so the push
+// time is approximated by the creation time of the image, or by the push
+// time recorded in the state file if the image was pushed from this
+// machine later. The creation time is usually close to the push time,
+// except for the images built with SOURCE_DATE_EPOCH, which appear to be
+// expiring unless the state file records their push.
+func expiresSoon(imageName string, opts *options) (bool, error) {
+	ref, err := parseReference(imageName, opts)
+	if err != nil {
+		return false, err
+	}
+
+	var created time.Time
+	err = withRetries(opts, "inspecting "+imageName, func() error {
+		image, err := remote.Image(ref, registryOptions(opts)...)
+		if err != nil {
+			return err
+		}
+		config, err := image.ConfigFile()
+		if err != nil {
+			return err
+		}
+		created = config.Created.Time
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("unable to get the creation time "+
+			"of '%s': %v", imageName, err)
+	}
+
+	pushed := created
+	if build, ok := recordedBuild(imageName, opts); ok &&
+		build.Pushed.After(pushed) {
+		pushed = build.Pushed
+	}
+
+	return time.Since(pushed) > opts.ephemeral/2, nil
+}
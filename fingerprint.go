@@ -1,20 +1,128 @@
 package main
 
 import (
+	"bytes"
+	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
 	"fmt"
 	"hash"
 	"io"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
+
+	"lukechampine.com/blake3"
 )
 
 func hex(h hash.Hash) string {
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
-func hashFiles(pathname string) (string, error) {
-	h := sha1.New()
+// secretArgHMAC returns the keyed hash that represents the value of a
+// secret build argument or a build secret in the fingerprint, so that the
+// value itself is never fed into the fingerprint. The key is the argument
+// name (or the secret ID) preceded by the salt from the
+// DOCKER_REUSE_SECRET_SALT environment variable. Without the salt, the key
+// is public: as the fingerprint is published in the image tag, a guessable
+// value can be confirmed by trying the candidates, so the hash only keeps
+// the value out of the output and the logs.
+func secretArgHMAC(name, value string) string {
+	mac := hmac.New(sha256.New,
+		[]byte(os.Getenv("DOCKER_REUSE_SECRET_SALT")+name))
+	mac.Write([]byte(value))
+	return hex(mac)
+}
+
+// countingHash counts the bytes written to the hash.
+type countingHash struct {
+	hash.Hash
+	count *int64
+}
+
+func (h countingHash) Write(p []byte) (int, error) {
+	*h.count += int64(len(p))
+	return h.Hash.Write(p)
+}
+
+// recordingHash keeps a copy of the bytes written to the hash.
+type recordingHash struct {
+	hash.Hash
+	record *bytes.Buffer
+}
+
+func (h recordingHash) Write(p []byte) (int, error) {
+	h.record.Write(p)
+	return h.Hash.Write(p)
+}
+
+// fingerprintInputVersion is the version of the format of the file
+// written by '-dump-fingerprint-input'. It must be incremented whenever
+// the lines fed to the fingerprint hash change for the same sources.
+const fingerprintInputVersion = 2
+
+// writeFingerprintInput writes the exact bytes that the fingerprint is
+// the hash of, preceded by a header line that names the format version
+// and the hash algorithm. The header itself is not hashed.
+func writeFingerprintInput(filename, algorithm string, input []byte) error {
+	header := fmt.Sprintf("docker-reuse-fingerprint-input v%d %s\n",
+		fingerprintInputVersion, algorithm)
+	return ioutil.WriteFile(filename,
+		append([]byte(header), input...), 0644)
+}
+
+// contentHashes maps the names of the content hashing algorithms
+// to their implementations.
+var contentHashes = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	// BLAKE3 hashes large files much faster than SHA-1 by processing
+	// multiple chunks at once using SIMD instructions.
+	"blake3": func() hash.Hash { return blake3.New(32, nil) },
+}
+
+// fingerprintModes lists the accepted values of the '-m' option
+// in addition to the 'exec:' mode.
+var fingerprintModes = []string{
+	"commit", "commit-dirty", "tree", "sha1", "sha256", "blake3"}
+
+// execModePrefix starts the '-m' option value that specifies the command
+// computing the hashes of the sources.
+const execModePrefix = "exec:"
+
+// getExecHash runs the user-provided command with the source pathname
+// as the argument and returns the trimmed standard output of the command.
+func getExecHash(command, pathname string) (string, error) {
+	cmd := exec.Command("sh", "-c", command+` "$@"`, "sh", pathname)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("'%s' failed for '%s': %v",
+			command, pathname, err)
+	}
+
+	hash := strings.TrimSpace(string(output))
+	if hash == "" {
+		return "", fmt.Errorf("'%s' produced no output for '%s'",
+			command, pathname)
+	}
+	return hash, nil
+}
+
+// pathFilter tells whether a file or directory takes part in content
+// hashing. Excluded directories are skipped entirely.
+type pathFilter func(pathname string, isDir bool) bool
+
+// hashFiles computes a hash of the file or directory tree at pathname.
+// Besides the file contents, the hash covers everything that COPY
+// transfers into the image: the paths relative to pathname, the file
+// mode bits, and the targets of symbolic links.
+func hashFiles(pathname string, newHash func() hash.Hash,
+	include pathFilter) (string, error) {
+
+	h := newHash()
 
 	err := filepath.Walk(pathname, func(p string,
 		info os.FileInfo, err error) error {
@@ -28,9 +136,39 @@ func hashFiles(pathname string) (string, error) {
 			if p != "." && filepath.Base(p)[0] == '.' {
 				return filepath.SkipDir
 			}
+		}
+
+		if include != nil && !include(p, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(pathname, p)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(h, "%s %s", filepath.ToSlash(rel), info.Mode())
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, " -> %s\n", target)
 			return nil
 		}
 
+		if !info.Mode().IsRegular() {
+			h.Write([]byte("\n"))
+			return nil
+		}
+
+		// The size separates the contents of adjacent files.
+		fmt.Fprintf(h, " %d\n", info.Size())
+
 		f, err := os.Open(p)
 		if err != nil {
 			return err
@@ -50,14 +188,15 @@ func hashFiles(pathname string) (string, error) {
 	return hex(h), nil
 }
 
-func parseAndHashDockerfile(dockerfile string) ([]string, string, error) {
+func parseAndHashDockerfile(dockerfile string, opts *options,
+	newHash func() hash.Hash) (*dockerfileSources, string, error) {
 	f, err := os.Open(dockerfile)
 	if err != nil {
 		return nil, "", err
 	}
 	defer f.Close()
 
-	sources, err := collectSourcesFromDockerfile(f)
+	sources, err := collectSourcesFromDockerfile(f, opts)
 	if err != nil {
 		return nil, "", err
 	}
@@ -66,7 +205,7 @@ func parseAndHashDockerfile(dockerfile string) ([]string, string, error) {
 		return nil, "", err
 	}
 
-	h := sha1.New()
+	h := newHash()
 	if _, err := io.Copy(h, f); err != nil {
 		return nil, "", err
 	}
@@ -74,18 +213,69 @@ func parseAndHashDockerfile(dockerfile string) ([]string, string, error) {
 	return sources, hex(h), nil
 }
 
-func computeFingerprint(workingDir, dockerfile string, buildArgs []string,
-	quiet bool) (string, error) {
-
+// computeFingerprint computes the image fingerprint from the Dockerfile,
+// the sources it references, and the build arguments. In the 'commit'
+// and 'tree' modes, sources are identified by their last git commit or
+// their git tree hash respectively, with a fallback to SHA-1 content
+// hashing. The 'commit-dirty' mode tolerates local modifications by
+// combining the last commit hash with a content hash of the modified
+// files. In the 'exec:' mode, the hash of each source is the output of
+// an external command. Other modes name the content hashing algorithm,
+// which is then also used for the fingerprint itself. Unless bytesHashed
+// is nil, the number of bytes fed to the content hashes is added to it.
+func computeFingerprint(workingDir string, opts *options,
+	bytesHashed *int64) (string, error) {
 	workingDir = filepath.Clean(workingDir)
 
+	mode := opts.mode
+	quiet := opts.quiet
+
+	dockerfile := opts.dockerfile
 	if dockerfile == "" {
 		dockerfile = filepath.Join(workingDir, "Dockerfile")
 	}
 
-	sources, hash, err := parseAndHashDockerfile(dockerfile)
+	var execCommand string
+	if strings.HasPrefix(mode, execModePrefix) {
+		execCommand = strings.TrimPrefix(mode, execModePrefix)
+		mode = "exec"
+	}
+
+	hashType := mode
+	if mode == "commit" || mode == "commit-dirty" || mode == "tree" ||
+		mode == "exec" {
+		hashType = "sha1"
+	}
+	newHash := contentHashes[hashType]
+	if bytesHashed != nil {
+		newHash = func() hash.Hash {
+			return countingHash{contentHashes[hashType](),
+				bytesHashed}
+		}
+	}
+
+	sources, hash, err := parseAndHashDockerfile(dockerfile, opts, newHash)
+	if err != nil {
+		return "", err
+	}
+
+	if err = checkUndeclaredArgs(opts.buildArgs, sources, dockerfile,
+		opts.strictArgs); err != nil {
+		return "", err
+	}
+
+	var tracked pathFilter
+	if opts.trackedOnly {
+		if tracked, err = trackedFilesFilter(workingDir); err != nil {
+			return "", err
+		}
+	}
 
-	h := sha1.New()
+	var input bytes.Buffer
+	h := contentHashes[hashType]()
+	if opts.dumpInput != "" {
+		h = recordingHash{h, &input}
+	}
 
 	addSourceHash := func(source, hashType, hash string) {
 		if !quiet {
@@ -94,28 +284,94 @@ func computeFingerprint(workingDir, dockerfile string, buildArgs []string,
 		h.Write([]byte(source + "@" + hashType + ":" + hash + "\n"))
 	}
 
-	addSourceHash("Dockerfile", "sha1", hash)
+	addSourceHash("Dockerfile", hashType, hash)
+
+	// Files excluded from the build context by .dockerignore cannot
+	// affect the image, so they are treated as excluded. The filter
+	// accepts the paths that are excluded by neither.
+	ignoredByDocker, err := dockerignoreFilter(workingDir)
+	if err != nil {
+		return "", err
+	}
+	notExcluded := combineFilters(
+		excludeFilter(workingDir, opts.excludes), ignoredByDocker)
 
 	hashSource := func(source, pathname string) error {
-		hash, err = getLastCommitHash(pathname)
-		if err == nil {
-			addSourceHash(source, "commit", hash)
-		} else {
+		if notExcluded != nil {
+			info, err := os.Stat(pathname)
+			if err != nil {
+				return err
+			}
+			if !notExcluded(pathname, info.IsDir()) {
+				if !quiet {
+					fmt.Println("Excluded:", source)
+				}
+				return nil
+			}
+		}
+
+		if mode == "exec" {
+			hash, err = getExecHash(execCommand, pathname)
+			if err != nil {
+				return err
+			}
+			addSourceHash(source, mode, hash)
+			return nil
+		}
+
+		if mode == "commit-dirty" {
+			var dirtyHash string
+			hash, dirtyHash, err = getDirtyCommitHash(
+				pathname, newHash)
+			if err == nil {
+				if dirtyHash == "" {
+					addSourceHash(source, "commit", hash)
+				} else {
+					addSourceHash(source, mode,
+						hash+"+"+dirtyHash)
+				}
+				return nil
+			}
+
 			fmt.Fprintf(os.Stderr, "Warning: unable to use git "+
 				"commit hash for '%s': %v; falling back to "+
 				"file content hashing\n", pathname, err)
+		} else if mode == "commit" || mode == "tree" {
+			getHash := getLastCommitHash
+			if mode == "tree" {
+				getHash = getTreeHash
+			}
+
+			hash, err = getHash(pathname)
+			if err == nil {
+				addSourceHash(source, mode, hash)
+				return nil
+			}
+
+			fmt.Fprintf(os.Stderr, "Warning: unable to use git "+
+				"%s hash for '%s': %v; falling back to "+
+				"file content hashing\n", mode, pathname, err)
+		}
 
-			hash, err = hashFiles(pathname)
+		var ignore pathFilter
+		if !opts.noGitignore {
+			ignore, err = gitignoreFilter(workingDir, pathname)
 			if err != nil {
 				return err
 			}
+		}
+		include := combineFilters(tracked, ignore, notExcluded)
 
-			addSourceHash(source, "sha1", hash)
+		hash, err = hashFiles(pathname, newHash, include)
+		if err != nil {
+			return err
 		}
+
+		addSourceHash(source, hashType, hash)
 		return nil
 	}
 
-	for _, source := range sources {
+	for _, source := range sources.paths {
 		source = filepath.Clean(source)
 		pathname := filepath.Join(workingDir, source)
 
@@ -146,13 +402,210 @@ func computeFingerprint(workingDir, dockerfile string, buildArgs []string,
 
 	}
 
-	for _, buildArg := range buildArgs {
+	for _, context := range opts.buildContexts {
+		name, value := splitBuildContext(context)
+		if strings.HasPrefix(value, dockerImagePrefix) {
+			image := strings.TrimPrefix(value, dockerImagePrefix)
+			digest, err := resolveImageDigest(image, opts)
+			if err != nil {
+				return "", err
+			}
+			addSourceHash("context:"+name, "digest", digest)
+		} else if isURL(value) || isGitURL(value) {
+			// Remote contexts are identified by their URL.
+			addSourceHash("context:"+name, "url", value)
+		} else if err = hashSource(
+			"context:"+name, value); err != nil {
+			return "", err
+		}
+	}
+
+	for _, file := range sources.urls {
+		hashType, hash, err := hashRemoteFile(file, opts)
+		if err != nil {
+			return "", err
+		}
+		addSourceHash(file.url, hashType, hash)
+	}
+
+	for _, repo := range sources.gitRepos {
+		// The checksum of a git repository is the commit hash,
+		// which makes the lookup unnecessary.
+		commit := repo.checksum
+		if commit == "" {
+			if commit, err = resolveGitURL(repo.url); err != nil {
+				return "", err
+			}
+		}
+		addSourceHash(repo.url, "git", commit)
+	}
+
+	for _, image := range sources.images {
+		digest, err := resolveImageDigest(image, opts)
+		if err != nil {
+			return "", err
+		}
+		addSourceHash(image, "digest", digest)
+	}
+
+	if opts.pinBase && sources.syntax != "" {
+		digest, err := resolveImageDigest(sources.syntax, opts)
+		if err != nil {
+			return "", err
+		}
+		addSourceHash("syntax "+sources.syntax, "digest", digest)
+	}
+
+	if opts.pinBase {
+		for _, image := range sources.baseImages {
+			digest, err := resolveImageDigest(image, opts)
+			if err != nil {
+				return "", err
+			}
+			addSourceHash("FROM "+image, "digest", digest)
+		}
+	}
+
+	// The defaults of the declared ARGs are covered by the Dockerfile
+	// hash, so the build arguments that merely repeat them are left out.
+	// The undeclared ones are kept as they are. So are the arguments
+	// that the user chose to ignore.
+	for _, buildArg := range opts.buildArgs {
+		parts := strings.SplitN(buildArg, "=", 2)
+		name := parts[0]
+		displayed := buildArg
+		if opts.secretArgs[name] && len(parts) == 2 {
+			buildArg = name + "=hmac-sha256:" +
+				secretArgHMAC(name, parts[1])
+			displayed = name + "=<secret>"
+		}
+		if opts.ignoredArgs[name] {
+			if !quiet {
+				fmt.Println("Arg (ignored):", displayed)
+			}
+			continue
+		}
+		if differs, declared := sources.overrides[name]; declared &&
+			!differs {
+			if !quiet {
+				fmt.Println("Arg (default):", displayed)
+			}
+			continue
+		}
 		if !quiet {
-			fmt.Println("Arg:", buildArg)
+			fmt.Println("Arg:", displayed)
 		}
 		h.Write([]byte(buildArg))
 		h.Write([]byte("\n"))
 	}
 
+	for _, id := range sshIDs(opts.ssh) {
+		if !quiet {
+			fmt.Println("SSH:", id)
+		}
+		h.Write([]byte("ssh:" + id + "\n"))
+	}
+
+	// Secrets, such as package registry tokens, can change the build
+	// result, so an HMAC of the values of those mounted by the stages
+	// being built (the contents of the secret files or the values of the
+	// environment variables) is included, the same as for the secret
+	// build arguments, unless the user chose to ignore them.
+	mounted := map[string]bool{}
+	for _, id := range sources.secrets {
+		mounted[id] = true
+	}
+	for _, spec := range opts.secrets {
+		id, value, err := readBuildSecret(spec)
+		if err != nil {
+			return "", err
+		}
+		if !mounted[id] {
+			if !quiet {
+				fmt.Println("Secret (not mounted):", id)
+			}
+			continue
+		}
+		if opts.ignoredSecret[id] {
+			if !quiet {
+				fmt.Println("Secret (ignored):", id)
+			}
+			continue
+		}
+		if !quiet {
+			fmt.Println("Secret:", id)
+		}
+		h.Write([]byte("secret:" + id + "=hmac-sha256:" +
+			secretArgHMAC(id, string(value)) + "\n"))
+	}
+
+	// The extra build flags are only included on request: many of
+	// them, such as '--network', do not affect the result.
+	if opts.hashFlags {
+		for _, buildFlag := range opts.buildFlags {
+			if !quiet {
+				fmt.Println("Build flag:", buildFlag)
+			}
+			h.Write([]byte("flag:" + buildFlag + "\n"))
+		}
+	}
+
+	// Attestation settings change the pushed manifest, so they are
+	// included if given explicitly.
+	for _, attestation := range []struct{ name, value string }{
+		{"provenance", opts.provenance}, {"sbom", opts.sbom}} {
+		if attestation.value == "" {
+			continue
+		}
+		setting := attestation.name + "=" + attestation.value
+		if !quiet {
+			fmt.Println("Attestation:", setting)
+		}
+		h.Write([]byte("attestation:" + setting + "\n"))
+	}
+
+	// The same sources produce different images for different target
+	// stages and platforms.
+	if opts.target != "" {
+		if !quiet {
+			fmt.Println("Target:", opts.target)
+		}
+		h.Write([]byte("target:" + opts.target + "\n"))
+	}
+	if len(opts.platforms) != 0 {
+		platforms := strings.Join(opts.platforms, ",")
+		if !quiet {
+			fmt.Println("Platform:", platforms)
+		}
+		h.Write([]byte("platform:" + platforms + "\n"))
+	}
+	if opts.injectArgs {
+		// The fingerprint itself becomes part of the image.
+		if !quiet {
+			fmt.Println("Option: inject-fingerprint")
+		}
+		h.Write([]byte("option:inject-fingerprint\n"))
+	}
+
+	if opts.dumpInput != "" {
+		if err = writeFingerprintInput(opts.dumpInput, hashType,
+			input.Bytes()); err != nil {
+			return "", err
+		}
+	}
+
 	return hex(h), nil
 }
+
+func isFingerprintMode(mode string) bool {
+	if strings.HasPrefix(mode, execModePrefix) {
+		return strings.TrimSpace(
+			strings.TrimPrefix(mode, execModePrefix)) != ""
+	}
+	for _, m := range fingerprintModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
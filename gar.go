@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/google"
+)
+
+// googleRegistry returns the host name of the registry of the image if it
+// is Google Artifact Registry or Google Container Registry, or an empty
+// string otherwise.
+func googleRegistry(imageName string, opts *options) string {
+	registry := imageRegistry(imageName, opts)
+	if strings.HasSuffix(registry, "-docker.pkg.dev") ||
+		registry == "gcr.io" || strings.HasSuffix(registry, ".gcr.io") {
+		return registry
+	}
+	return ""
+}
+
+// googleCredentials obtains an access token for the Google registry with
+// the Google keychain of go-containerregistry, which uses Application
+// Default Credentials or, failing that, the gcloud command. The token is
+// only sent to that registry.
+func googleCredentials(registry string) (*registryCredentials, error) {
+	target, err := name.NewRegistry(registry)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := google.Keychain.Resolve(target)
+	if err != nil {
+		return nil, fmt.Errorf("unable to obtain an access token "+
+			"for %s: %v", registry, err)
+	}
+	config, err := auth.Authorization()
+	if err != nil {
+		return nil, fmt.Errorf("unable to obtain an access token "+
+			"for %s: %v", registry, err)
+	}
+	// The keychain falls back to anonymous access.
+	if config.Password == "" {
+		return nil, fmt.Errorf("unable to obtain an access token "+
+			"for %s: no Application Default Credentials or gcloud "+
+			"credentials found", registry)
+	}
+
+	return &registryCredentials{registry: registry,
+		user: config.Username, password: config.Password}, nil
+}
@@ -2,66 +2,100 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/storage/memory"
 )
 
-func getLastCommitHash(pathname string) (string, error) {
+// openRepository opens the git repository containing pathname. It returns
+// the repository, the worktree root, the path relative to the root (empty
+// if pathname is the root itself), and the status of the worktree.
+func openRepository(pathname string) (*git.Repository, string, string,
+	git.Status, error) {
+
 	abs, err := filepath.Abs(pathname)
 	if err != nil {
-		return "", err
+		return nil, "", "", nil, err
 	}
 
 	r, err := git.PlainOpenWithOptions(abs,
 		&git.PlainOpenOptions{DetectDotGit: true})
 	if err != nil {
-		return "", err
+		return nil, "", "", nil, err
 	}
 
 	wt, err := r.Worktree()
 	if err != nil {
-		return "", err
+		return nil, "", "", nil, err
 	}
 	root := wt.Filesystem.Root()
 
 	status, err := wt.Status()
 	if err != nil {
-		return "", err
+		return nil, "", "", nil, err
 	}
 
-	var clean bool
-
-	logOptions := &git.LogOptions{}
+	var rel string
 
 	if root != abs {
-		rel, err := filepath.Rel(root, abs)
+		rel, err = filepath.Rel(root, abs)
 		if err != nil {
 			// This will never happen because the worktree
 			// root is derived from 'pathname'.
 			panic(err)
 		}
+	}
 
-		logOptions.PathFilter = func(s string) bool {
-			return strings.HasPrefix(s, rel)
-		}
+	return r, root, rel, status, nil
+}
 
-		clean = true
-		for f, s := range status {
-			if (s.Worktree != git.Unmodified ||
-				s.Staging != git.Unmodified) &&
-				strings.HasPrefix(f, rel) {
-				clean = false
-				break
-			}
+// modifiedFiles returns the sorted list of files under rel that are
+// modified, staged, or untracked.
+func modifiedFiles(status git.Status, rel string) []string {
+	var files []string
+	for f, s := range status {
+		if (s.Worktree != git.Unmodified ||
+			s.Staging != git.Unmodified) &&
+			strings.HasPrefix(f, rel) {
+			files = append(files, f)
 		}
-	} else {
-		clean = status.IsClean()
 	}
+	sort.Strings(files)
+	return files
+}
 
-	if !clean {
-		return "", errors.New("local modifications detected")
+// openCleanRepository opens the git repository containing pathname and
+// checks that pathname has no local modifications. It returns the
+// repository and the path relative to the worktree root.
+func openCleanRepository(pathname string) (*git.Repository, string, error) {
+	r, _, rel, status, err := openRepository(pathname)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(modifiedFiles(status, rel)) != 0 {
+		return nil, "", errors.New("local modifications detected")
+	}
+
+	return r, rel, nil
+}
+
+func lastCommitHash(r *git.Repository, rel string) (string, error) {
+	logOptions := &git.LogOptions{}
+
+	if rel != "" {
+		logOptions.PathFilter = func(s string) bool {
+			return strings.HasPrefix(s, rel)
+		}
 	}
 
 	commitIter, err := r.Log(logOptions)
@@ -80,3 +114,223 @@ func getLastCommitHash(pathname string) (string, error) {
 
 	return lastCommit.Hash.String(), nil
 }
+
+func getLastCommitHash(pathname string) (string, error) {
+	r, rel, err := openCleanRepository(pathname)
+	if err != nil {
+		return "", err
+	}
+
+	return lastCommitHash(r, rel)
+}
+
+// getDirtyCommitHash returns the last commit hash for pathname along
+// with a content hash of the files under pathname that have local
+// modifications. The second hash is empty if there are no modifications.
+func getDirtyCommitHash(pathname string,
+	newHash func() hash.Hash) (string, string, error) {
+
+	r, root, rel, status, err := openRepository(pathname)
+	if err != nil {
+		return "", "", err
+	}
+
+	commit, err := lastCommitHash(r, rel)
+	if err != nil {
+		return "", "", err
+	}
+
+	files := modifiedFiles(status, rel)
+	if len(files) == 0 {
+		return commit, "", nil
+	}
+
+	h := newHash()
+
+	for _, f := range files {
+		s := status[f]
+		fmt.Fprintf(h, "%s %c%c\n", f, s.Staging, s.Worktree)
+
+		contents, err := os.Open(filepath.Join(root, f))
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Deleted files only contribute their status.
+				continue
+			}
+			return "", "", err
+		}
+
+		_, err = io.Copy(h, contents)
+		contents.Close()
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	return commit, hex(h), nil
+}
+
+// getTreeHash returns the hash of the git tree (or blob) object that
+// pathname refers to in the HEAD commit. Unlike the last commit hash,
+// it does not change when unrelated commits are rebased or merged.
+func getTreeHash(pathname string) (string, error) {
+	r, rel, err := openCleanRepository(pathname)
+	if err != nil {
+		return "", err
+	}
+
+	head, err := r.Head()
+	if err != nil {
+		return "", err
+	}
+
+	commit, err := r.CommitObject(head.Hash())
+	if err != nil {
+		return "", err
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return "", err
+	}
+
+	if rel == "" {
+		return tree.Hash.String(), nil
+	}
+
+	entry, err := tree.FindEntry(filepath.ToSlash(rel))
+	if err != nil {
+		return "", err
+	}
+
+	return entry.Hash.String(), nil
+}
+
+// trackedFilesFilter returns a filter that only accepts the files listed
+// in the git index of the repository containing pathname and the
+// directories leading to them.
+func trackedFilesFilter(pathname string) (pathFilter, error) {
+	abs, err := filepath.Abs(pathname)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := git.PlainOpenWithOptions(abs,
+		&git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return nil, err
+	}
+
+	wt, err := r.Worktree()
+	if err != nil {
+		return nil, err
+	}
+	root := wt.Filesystem.Root()
+
+	idx, err := r.Storer.Index()
+	if err != nil {
+		return nil, err
+	}
+
+	tracked := map[string]bool{}
+	dirs := map[string]bool{root: true}
+
+	for _, entry := range idx.Entries {
+		p := filepath.Join(root, filepath.FromSlash(entry.Name))
+		tracked[p] = true
+
+		for dir := filepath.Dir(p); !dirs[dir]; dir = filepath.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+
+	return func(p string, isDir bool) bool {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return false
+		}
+		if isDir {
+			return dirs[abs]
+		}
+		return tracked[abs]
+	}, nil
+}
+
+// isGitURL tells whether an ADD source refers to a git repository, using
+// the same rules as BuildKit for the supported URL forms.
+func isGitURL(source string) bool {
+	if strings.HasPrefix(source, "git://") ||
+		strings.HasPrefix(source, "git@") ||
+		strings.HasPrefix(source, "ssh://") {
+		return true
+	}
+	remote := strings.SplitN(source, "#", 2)[0]
+	return isURL(remote) && strings.HasSuffix(remote, ".git")
+}
+
+// resolveGitURL resolves the reference in the fragment of the git URL
+// ('URL#ref:subdir') to a commit hash by listing the remote references.
+// Without a reference, the default branch is used.
+func resolveGitURL(source string) (string, error) {
+	parts := strings.SplitN(source, "#", 2)
+	url, ref := parts[0], ""
+	if len(parts) == 2 {
+		ref = strings.SplitN(parts[1], ":", 2)[0]
+	}
+
+	if plumbing.IsHash(ref) {
+		return ref, nil
+	}
+
+	remote := git.NewRemote(memory.NewStorage(),
+		&config.RemoteConfig{Name: "origin", URLs: []string{url}})
+	refs, err := remote.List(&git.ListOptions{})
+	if err != nil {
+		return "", fmt.Errorf("'%s': %v", url, err)
+	}
+
+	byName := map[plumbing.ReferenceName]*plumbing.Reference{}
+	for _, r := range refs {
+		byName[r.Name()] = r
+	}
+
+	var candidates []plumbing.ReferenceName
+	if ref == "" {
+		candidates = []plumbing.ReferenceName{plumbing.HEAD}
+	} else {
+		candidates = []plumbing.ReferenceName{
+			plumbing.NewBranchReferenceName(ref),
+			plumbing.NewTagReferenceName(ref),
+			plumbing.ReferenceName(ref)}
+	}
+
+	for _, name := range candidates {
+		r := byName[name]
+		// Follow symbolic references, such as HEAD.
+		for r != nil && r.Type() == plumbing.SymbolicReference {
+			r = byName[r.Target()]
+		}
+		if r != nil {
+			return r.Hash().String(), nil
+		}
+	}
+
+	return "", fmt.Errorf("'%s' does not have reference '%s'", url, ref)
+}
+
+// getHeadCommit returns the hash of the commit checked out in the
+// repository containing pathname.
+func getHeadCommit(pathname string) (string, error) {
+	r, err := git.PlainOpenWithOptions(pathname,
+		&git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return "", err
+	}
+
+	head, err := r.Head()
+	if err != nil {
+		return "", err
+	}
+
+	return head.Hash().String(), nil
+}
@@ -3,6 +3,13 @@ module github.com/revl/docker-reuse
 go 1.13
 
 require (
+	github.com/aws/aws-sdk-go v1.31.6
+	github.com/docker/docker v20.10.0-beta1.0.20201110211921-af34b94a78a1+incompatible
 	github.com/go-git/go-git/v5 v5.2.0
+	github.com/google/go-containerregistry v0.4.0
+	github.com/hashicorp/hcl/v2 v2.8.2
 	github.com/moby/buildkit v0.8.1
+	github.com/zclconf/go-cty v1.2.0
+	gopkg.in/yaml.v2 v2.4.0
+	lukechampine.com/blake3 v1.1.7
 )
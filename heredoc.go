@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// reHeredoc matches the heredoc markers (<<EOF, <<-EOF, <<"EOF") in an
+// instruction. The second submatch is the terminator word.
+var reHeredoc = regexp.MustCompile(`(?:^|\s)<<(-?)["']?(\w+)["']?`)
+
+// isHeredocSource tells whether the COPY or ADD source is a heredoc,
+// whose contents are part of the Dockerfile itself.
+func isHeredocSource(source string) bool {
+	return strings.HasPrefix(source, "<<")
+}
+
+// blankHeredocs returns a copy of the Dockerfile with the heredoc bodies
+// replaced with empty lines, so that the Dockerfile can be processed by
+// the parser, which does not support heredocs. Line numbers are preserved.
+func blankHeredocs(r io.Reader) (io.Reader, error) {
+	var output bytes.Buffer
+
+	type terminator struct {
+		word      string
+		stripTabs bool
+	}
+	var pending []terminator
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if len(pending) != 0 {
+			end := strings.TrimRight(line, "\r")
+			if pending[0].stripTabs {
+				end = strings.TrimLeft(end, "\t")
+			}
+			if end == pending[0].word {
+				pending = pending[1:]
+			}
+			output.WriteString("\n")
+			continue
+		}
+
+		if !strings.HasPrefix(strings.TrimSpace(line), "#") {
+			for _, m := range reHeredoc.FindAllStringSubmatch(
+				line, -1) {
+				pending = append(pending,
+					terminator{m[2], m[1] == "-"})
+			}
+		}
+
+		output.WriteString(line)
+		output.WriteString("\n")
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &output, nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/pkg/fileutils"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"github.com/moby/buildkit/frontend/dockerfile/dockerignore"
+)
+
+// combineFilters returns a filter that accepts the paths accepted by all
+// of the given filters. Nil filters are skipped.
+func combineFilters(filters ...pathFilter) pathFilter {
+	var nonNil []pathFilter
+	for _, filter := range filters {
+		if filter != nil {
+			nonNil = append(nonNil, filter)
+		}
+	}
+
+	switch len(nonNil) {
+	case 0:
+		return nil
+	case 1:
+		return nonNil[0]
+	}
+
+	return func(pathname string, isDir bool) bool {
+		for _, filter := range nonNil {
+			if !filter(pathname, isDir) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// readGitignore parses the .gitignore file in dir, if there is one.
+func readGitignore(dir string, domain []string) ([]gitignore.Pattern, error) {
+	f, err := os.Open(filepath.Join(dir, ".gitignore"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []gitignore.Pattern
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if !strings.HasPrefix(line, "#") &&
+			strings.TrimSpace(line) != "" {
+			patterns = append(patterns,
+				gitignore.ParsePattern(line, domain))
+		}
+	}
+
+	return patterns, scanner.Err()
+}
+
+// gitignoreFilter returns a filter that excludes the files ignored by the
+// .gitignore files of the repository containing the source at pathname.
+// Outside of a git repository, the .gitignore files found in workingDir
+// and its subdirectories are used. The .gitignore files are loaded lazily
+// as the directory tree is walked. If the source itself is ignored (as is
+// common for build output that is copied into the image), the .gitignore
+// rules are not applied to it and the returned filter is nil.
+func gitignoreFilter(workingDir, pathname string) (pathFilter, error) {
+	abs, err := filepath.Abs(pathname)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := filepath.Abs(workingDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if r, err := git.PlainOpenWithOptions(abs,
+		&git.PlainOpenOptions{DetectDotGit: true}); err == nil {
+		if wt, err := r.Worktree(); err == nil {
+			root = wt.Filesystem.Root()
+		}
+	}
+
+	var patterns []gitignore.Pattern
+	loaded := map[string]bool{}
+
+	var load func(dir string) error
+	load = func(dir string) error {
+		if loaded[dir] {
+			return nil
+		}
+		if dir != root {
+			if err := load(filepath.Dir(dir)); err != nil {
+				return err
+			}
+		}
+
+		var domain []string
+		if dir != root {
+			rel, _ := filepath.Rel(root, dir)
+			domain = strings.Split(filepath.ToSlash(rel), "/")
+		}
+
+		dirPatterns, err := readGitignore(dir, domain)
+		if err != nil {
+			return err
+		}
+		patterns = append(patterns, dirPatterns...)
+		loaded[dir] = true
+		return nil
+	}
+
+	var loadErr error
+
+	ignored := func(p string, isDir bool) bool {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return false
+		}
+
+		rel, err := filepath.Rel(root, abs)
+		if err != nil || rel == "." || rel == ".." ||
+			strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return false
+		}
+
+		if err = load(filepath.Dir(abs)); err != nil {
+			loadErr = err
+			return false
+		}
+
+		return gitignore.NewMatcher(patterns).Match(
+			strings.Split(filepath.ToSlash(rel), "/"), isDir)
+	}
+
+	info, err := os.Stat(abs)
+	if err != nil {
+		return nil, err
+	}
+	if ignored(abs, info.IsDir()) {
+		return nil, loadErr
+	}
+	if loadErr != nil {
+		return nil, loadErr
+	}
+
+	return func(p string, isDir bool) bool {
+		return !ignored(p, isDir)
+	}, nil
+}
+
+// excludeFilter returns a filter that rejects the paths matching any of
+// the patterns, which use the .gitignore syntax and are relative to
+// workingDir. It returns nil if there are no patterns.
+func excludeFilter(workingDir string, excludes []string) pathFilter {
+	if len(excludes) == 0 {
+		return nil
+	}
+
+	var patterns []gitignore.Pattern
+	for _, exclude := range excludes {
+		patterns = append(patterns, gitignore.ParsePattern(exclude, nil))
+	}
+	matcher := gitignore.NewMatcher(patterns)
+
+	return func(p string, isDir bool) bool {
+		rel, err := filepath.Rel(workingDir, p)
+		if err != nil || rel == "." {
+			return true
+		}
+		return !matcher.Match(
+			strings.Split(filepath.ToSlash(rel), "/"), isDir)
+	}
+}
+
+// dockerignoreFilter returns a filter that rejects the paths excluded
+// from the build context by the .dockerignore file in workingDir, using
+// the same matching rules as docker build. It returns nil if there is
+// no .dockerignore file.
+func dockerignoreFilter(workingDir string) (pathFilter, error) {
+	f, err := os.Open(filepath.Join(workingDir, ".dockerignore"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	patterns, err := dockerignore.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+
+	matcher, err := fileutils.NewPatternMatcher(patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(p string, isDir bool) bool {
+		rel, err := filepath.Rel(workingDir, p)
+		if err != nil || rel == "." {
+			return true
+		}
+		// Files inside an ignored directory can be re-included
+		// by exclusion patterns, so such directories are still
+		// walked.
+		if isDir && matcher.Exclusions() {
+			return true
+		}
+		excluded, err := matcher.Matches(rel)
+		return err != nil || !excluded
+	}, nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+)
+
+type lintFinding struct {
+	line    int
+	message string
+}
+
+var (
+	reRunCd         = regexp.MustCompile(`(?:^|&&|;)\s*cd\s`)
+	reAptGetInstall = regexp.MustCompile(`apt-get\s+(?:[^&;|]*\s)?install\s`)
+	reAptGetYes     = regexp.MustCompile(`\s(?:-[a-zA-Z]*y|--yes|--assume-yes)\b`)
+	reArchive       = regexp.MustCompile(`\.(?:tar|tgz|tbz2?|txz|gz|bz2|xz)$`)
+)
+
+// checkDockerfile applies a small built-in subset of Dockerfile best
+// practice rules to the parsed AST.
+func checkDockerfile(root *parser.Node) []lintFinding {
+	var findings []lintFinding
+
+	add := func(node *parser.Node, format string, a ...interface{}) {
+		findings = append(findings,
+			lintFinding{node.StartLine, fmt.Sprintf(format, a...)})
+	}
+
+	stages := map[string]bool{}
+	seenFrom := false
+	var cmdSeen, entrypointSeen bool
+
+	for _, child := range root.Children {
+		switch child.Value {
+		case "arg":
+			continue
+		case "from":
+			seenFrom = true
+			cmdSeen, entrypointSeen = false, false
+
+			if child.Next == nil {
+				continue
+			}
+			image := child.Next.Value
+			if image != "scratch" && !stages[strings.ToLower(image)] &&
+				!strings.Contains(image, "$") &&
+				!strings.Contains(image, "@") &&
+				!strings.Contains(image[strings.LastIndex(
+					image, "/")+1:], ":") {
+				add(child, "always tag the version of "+
+					"the base image '%s'", image)
+			}
+			if n := child.Next.Next; n != nil &&
+				strings.EqualFold(n.Value, "as") && n.Next != nil {
+				stages[strings.ToLower(n.Next.Value)] = true
+			}
+			continue
+		}
+
+		if !seenFrom {
+			add(child, "the first instruction must be FROM")
+			seenFrom = true
+		}
+
+		switch child.Value {
+		case "maintainer":
+			add(child, "MAINTAINER is deprecated, use LABEL instead")
+		case "cmd":
+			if cmdSeen {
+				add(child, "multiple CMD instructions in "+
+					"one stage, only the last one takes effect")
+			}
+			cmdSeen = true
+		case "entrypoint":
+			if entrypointSeen {
+				add(child, "multiple ENTRYPOINT instructions in "+
+					"one stage, only the last one takes effect")
+			}
+			entrypointSeen = true
+		case "workdir":
+			if child.Next != nil {
+				dir := child.Next.Value
+				if !strings.HasPrefix(dir, "/") &&
+					!strings.HasPrefix(dir, "$") {
+					add(child, "use an absolute WORKDIR "+
+						"instead of '%s'", dir)
+				}
+			}
+		case "run":
+			if child.Next == nil || child.Attributes["json"] {
+				continue
+			}
+			script := child.Next.Value
+			if reRunCd.MatchString(script) {
+				add(child, "use WORKDIR to switch to a directory")
+			}
+			if reAptGetInstall.MatchString(script) &&
+				!reAptGetYes.MatchString(script) {
+				add(child, "'apt-get install' is missing "+
+					"the '-y' switch")
+			}
+		case "add":
+			if child.Next == nil {
+				continue
+			}
+			for src := child.Next; src.Next != nil; src = src.Next {
+				if !isHeredocSource(src.Value) &&
+					!strings.Contains(src.Value, "://") &&
+					!reArchive.MatchString(src.Value) {
+					add(child, "use COPY instead of ADD "+
+						"for '%s'", src.Value)
+				}
+			}
+		}
+	}
+
+	return findings
+}
+
+// lintDockerfile checks the Dockerfile before the build. If hadolint is
+// available, it is used instead of the built-in rules. Either way, the
+// Dockerfile is checked with the heredoc bodies blanked out, the same as
+// it is parsed for the fingerprint, so that the scripts and files embedded
+// in it are not mistaken for instructions. Depending on the mode, the
+// findings are either reported as warnings or cause an error.
+func lintDockerfile(workingDir, dockerfile, mode string) error {
+	if mode == "off" {
+		return nil
+	}
+
+	if dockerfile == "" {
+		dockerfile = filepath.Join(workingDir, "Dockerfile")
+	}
+
+	f, err := os.Open(dockerfile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	blanked, err := blankHeredocs(f)
+	if err != nil {
+		return err
+	}
+	contents, err := ioutil.ReadAll(blanked)
+	if err != nil {
+		return err
+	}
+
+	var failed bool
+
+	if hadolint, err := exec.LookPath("hadolint"); err == nil {
+		// hadolint reads the Dockerfile from the standard input and
+		// reports the findings as '-:LINE ...'; the line numbers are
+		// preserved by blankHeredocs.
+		var output bytes.Buffer
+		cmd := exec.Command(hadolint, "-")
+		cmd.Stdin = bytes.NewReader(contents)
+		cmd.Stdout = &output
+		cmd.Stderr = os.Stderr
+		err = cmd.Run()
+		for _, line := range strings.SplitAfter(output.String(), "\n") {
+			if strings.HasPrefix(line, "-:") {
+				line = dockerfile + line[1:]
+			}
+			fmt.Fprint(os.Stderr, line)
+		}
+		if err != nil {
+			if _, ok := err.(*exec.ExitError); !ok {
+				return err
+			}
+			failed = true
+		}
+	} else {
+		res, err := parser.Parse(bytes.NewReader(contents))
+		if err != nil {
+			return err
+		}
+
+		for _, finding := range checkDockerfile(res.AST) {
+			fmt.Fprintf(os.Stderr, "Lint: %s:%d: %s\n",
+				dockerfile, finding.line, finding.message)
+			failed = true
+		}
+	}
+
+	if !failed {
+		return nil
+	}
+
+	if mode == "error" {
+		return fmt.Errorf("'%s' did not pass lint checks", dockerfile)
+	}
+
+	fmt.Fprintf(os.Stderr, "Warning: '%s' did not pass lint checks\n",
+		dockerfile)
+	return nil
+}
+
+func checkLintMode(mode string) error {
+	switch mode {
+	case "off", "warn", "error":
+		return nil
+	}
+	return errors.New("lint mode must be one of 'warn', 'error', or 'off'")
+}
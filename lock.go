@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// The labels of the lock image.
+const (
+	lockOwnerLabel = "docker-reuse.lock-owner"
+	lockTimeLabel  = "docker-reuse.lock-time"
+)
+
+// lockSettleDelay is how long a run waits after pushing the lock before
+// checking that the lock has not been overwritten by a concurrent run.
+const lockSettleDelay = 2 * time.Second
+
+// lockPollInterval is how often the waiting runs check the registry.
+const lockPollInterval = 5 * time.Second
+
+// buildLock is a lock on building an image, held by pushing a tiny image
+// under the fingerprint tag with the '-lock' suffix. The tag is mutable,
+// and the registries offer no compare-and-swap, so the lock is only a best
+// effort to avoid duplicate builds, not a guarantee of mutual exclusion.
+type buildLock struct {
+	ref   name.Reference
+	owner string
+}
+
+// newLockOwner returns a string that identifies this run among the runs
+// competing for the lock.
+func newLockOwner() string {
+	host, _ := os.Hostname()
+	var nonce [8]byte
+	rand.Read(nonce[:])
+	return fmt.Sprintf("%s/%d/%x", host, os.Getpid(), nonce)
+}
+
+// readLock returns the owner of the lock and the time it was taken,
+// or an empty owner if there is no lock.
+func readLock(ref name.Reference, opts *options) (string, time.Time,
+	error) {
+
+	image, err := remote.Image(ref, registryOptions(opts)...)
+	if err != nil {
+		if isNotFound(err) {
+			return "", time.Time{}, nil
+		}
+		return "", time.Time{}, err
+	}
+	config, err := image.ConfigFile()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	labels := config.Config.Labels
+	// A lock with an unreadable time is treated as stale.
+	taken, _ := time.Parse(time.RFC3339, labels[lockTimeLabel])
+	return labels[lockOwnerLabel], taken, nil
+}
+
+// writeLock pushes the lock image.
+func writeLock(ref name.Reference, owner string, opts *options) error {
+	image, err := mutate.Config(empty.Image, v1.Config{
+		Labels: map[string]string{
+			lockOwnerLabel: owner,
+			lockTimeLabel:  time.Now().UTC().Format(time.RFC3339),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return remote.Write(ref, image, registryOptions(opts)...)
+}
+
+// isImmutableTag tells whether pushing the manifest failed because the
+// registry does not allow overwriting the tag, such as an ECR repository
+// with immutable tags or a repository with a tag immutability rule in
+// Harbor or Artifact Registry.
+func isImmutableTag(err error) bool {
+	var transportErr *transport.Error
+	if !errors.As(err, &transportErr) {
+		return false
+	}
+	for _, diagnostic := range transportErr.Errors {
+		if diagnostic.Code == transport.TagInvalidErrorCode ||
+			strings.Contains(strings.ToLower(diagnostic.Message),
+				"immutable") {
+			return true
+		}
+	}
+	return false
+}
+
+// acquireBuildLock makes sure that only one of the concurrent runs builds
+// the image. Registries provide no atomic operations, so the run pushes
+// the lock and, after a delay, checks whether a concurrent run has
+// overwritten it; the last one to push the lock wins. The other runs wait
+// until the image appears in the registry, in which case the returned
+// lock is nil and the boolean result is true, or until the lock is
+// released or becomes older than '-lock', in which case they compete for
+// the lock again.
+//
+// Without '-lock', the run only waits for a build that holds a lock taken
+// less than '-wait-for-existing' ago. With '-wait-for-existing', the run
+// gives up waiting after that long and builds the image without the lock.
+// So does the run that cannot replace an abandoned lock because the
+// registry has immutable tags.
+func acquireBuildLock(imageName string, opts *options) (*buildLock,
+	bool, error) {
+
+	ref, err := parseReference(imageName+"-lock", opts)
+	if err != nil {
+		return nil, false, err
+	}
+	owner := newLockOwner()
+	lockTTL := opts.lockTTL
+	if lockTTL == 0 {
+		lockTTL = opts.waitTimeout
+	}
+	start := time.Now()
+	waiting := false
+
+	for {
+		exists, err := imageExists(imageName, opts)
+		if err != nil {
+			return nil, false, err
+		}
+		if exists {
+			return nil, true, nil
+		}
+
+		currentOwner, taken, err := readLock(ref, opts)
+		if err != nil {
+			return nil, false, fmt.Errorf("unable to read "+
+				"the build lock '%s': %v", ref, err)
+		}
+
+		if currentOwner == "" || time.Since(taken) > lockTTL {
+			if opts.lockTTL == 0 {
+				return nil, false, nil
+			}
+			if err = writeLock(ref, owner, opts); err != nil {
+				if isImmutableTag(err) {
+					fmt.Fprintf(os.Stderr, "Warning: the "+
+						"registry does not allow "+
+						"overwriting the build lock "+
+						"'%s' (immutable tags); "+
+						"building without the lock\n",
+						ref)
+					return nil, false, nil
+				}
+				return nil, false, fmt.Errorf("unable to push "+
+					"the build lock '%s': %v", ref, err)
+			}
+			time.Sleep(lockSettleDelay)
+			if currentOwner, _, err = readLock(ref, opts); err != nil {
+				return nil, false, err
+			}
+			if currentOwner == owner {
+				return &buildLock{ref, owner}, false, nil
+			}
+		}
+
+		if opts.waitTimeout != 0 &&
+			time.Since(start) > opts.waitTimeout {
+			fmt.Fprintf(os.Stderr, "Warning: gave up waiting for "+
+				"the build by %s after %v\n", currentOwner,
+				opts.waitTimeout)
+			return nil, false, nil
+		}
+
+		if !waiting && !opts.quiet {
+			fmt.Println("Waiting for the build by", currentOwner)
+		}
+		waiting = true
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// release deletes the lock, so that the waiting runs can take over if
+// the build has failed. Registries that do not allow deleting manifests
+// leave the lock to expire.
+func (l *buildLock) release(opts *options) {
+	desc, err := remote.Head(l.ref, registryOptions(opts)...)
+	if err == nil {
+		err = remote.Delete(l.ref.Context().Digest(desc.Digest.String()),
+			registryOptions(opts)...)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: unable to release "+
+			"the build lock '%s': %v\n", l.ref, err)
+	}
+}
@@ -4,133 +4,865 @@ package main
 
 import (
 	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"os/exec"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
 )
 
 func runDockerCmd(quiet bool, arg ...string) error {
-	cmd := exec.Command("docker", arg...)
+	arg = builderArgs(arg)
+	cmd := exec.Command(buildTool, arg...)
 	cmd.Stderr = os.Stderr
 	if !quiet {
 		cmd.Stdout = os.Stdout
-		fmt.Println("Run: docker", strings.Join(arg, " "))
+		fmt.Println("Run:", buildTool, strings.Join(arg, " "))
 	}
 	return cmd.Run()
 }
 
-func findOrBuildAndPushImage(workingDir, imageName, templateFilename,
-	placeholderString, dockerfile string,
-	buildArgs []string, quiet bool) error {
+// dockerCmdOutput runs a docker command and returns its standard output.
+func dockerCmdOutput(arg ...string) ([]byte, error) {
+	cmd := exec.Command(buildTool, builderArgs(arg)...)
+	cmd.Stderr = os.Stderr
+	return cmd.Output()
+}
 
-	templateContents, err := ioutil.ReadFile(templateFilename)
+// resolveImageDigest returns the digest of the image reference, looking
+// it up in the registry unless the reference already includes it.
+func resolveImageDigest(imageName string, opts *options) (string, error) {
+	if at := strings.LastIndexByte(imageName, '@'); at >= 0 {
+		return imageName[at+1:], nil
+	}
+	digest, err := getImageDigest(imageName, opts)
 	if err != nil {
-		return err
+		return "", fmt.Errorf("unable to resolve the digest "+
+			"of '%s': %v", imageName, err)
 	}
+	return digest, nil
+}
+
+// fingerprintLabel is the image label that stores the fingerprint.
+const fingerprintLabel = "docker-reuse.fingerprint"
+
+// buildDurationLabel is the image label that stores the time it took
+// to build the image.
+const buildDurationLabel = "docker-reuse.build-duration"
+
+// getImageLabels returns the labels of the image stored in the registry.
+// For multi-platform images, the labels of the first platform are used;
+// attestation manifests are not considered.
+func getImageLabels(imageName string,
+	opts *options) (map[string]string, error) {
+
+	if buildTool != "docker" {
+		return registryImageLabels(imageName, opts)
+	}
+
+	var output []byte
+	err := withRetries(opts, "inspecting "+imageName, func() (err error) {
+		output, err = dockerCmdOutput(buildxArgs(opts, "imagetools",
+			"inspect", "--format", "{{json .Image}}", imageName)...)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	type imageConfig struct {
+		Config struct {
+			Labels map[string]string
+		} `json:"config"`
+	}
+
+	var image imageConfig
+	if err = json.Unmarshal(output, &image); err == nil &&
+		image.Config.Labels != nil {
+		return image.Config.Labels, nil
+	}
+
+	var platforms map[string]imageConfig
+	if json.Unmarshal(output, &platforms) == nil {
+		var keys []string
+		for key := range platforms {
+			// Skip the attestation manifests, which buildx
+			// reports under the 'unknown/unknown' platform.
+			if key != "unknown/unknown" {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) != 0 {
+			sort.Strings(keys)
+			return platforms[keys[0]].Config.Labels, nil
+		}
+	}
+
+	return image.Config.Labels, nil
+}
+
+// options holds the settings that control how the image is found or built.
+type options struct {
+	dockerfile    string
+	target        string
+	platforms     []string
+	placeholder   string
+	format        string
+	fingerprint   string
+	mode          string
+	dumpInput     string
+	trackedOnly   bool
+	noGitignore   bool
+	excludes      []string
+	buildContexts []string
+	alsoCheck     []string
+	mirrors       []string
+	pinBase       bool
+	urlMode       string
+	forceRebuild  bool
+	injectArgs    bool
+	immutableTags bool
+	noBuild       bool
+	buildxPush    bool
+	buildxBuilder string
+	// resolveDigest requests the manifest digest of the resulting
+	// image to be included in the result.
+	resolveDigest bool
+	buildArgs     []string
+	secretArgs    map[string]bool
+	argFiles      map[string]string
+	ignoredArgs   map[string]bool
+	strictArgs    bool
+	allowBinary   bool
+	postUpdate    string
+	credentials   *registryCredentials
+	insecureHosts map[string]bool
+	caCerts       *x509.CertPool
+	proxy         *url.URL
+	visibility    string
+	ecr           bool
+	gar           bool
+	acr           bool
+	retries       int
+	retryDelay    time.Duration
+	ssh           []string
+	secrets       []string
+	ignoredSecret map[string]bool
+	cacheFrom     []string
+	cacheTo       []string
+	buildFlags    []string
+	hashFlags     bool
+	noAutoCache   bool
+	inlineCache   bool
+	provenance    string
+	sbom          string
+	tags          []string
+	tagsOnReuse   string
+	forceTagMove  bool
+	dryRun        bool
+	lintMode      string
+	ephemeral     time.Duration
+	digestRefs    bool
+	verifyReuse   string
+	stateFile     string
+	lockTTL       time.Duration
+	waitTimeout   time.Duration
+	quiet         bool
+}
+
+// stringList is a flag.Value that collects the values of a repeatable flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// findPlaceholder returns the string to be replaced with the new image
+// reference in the template file.
+func findPlaceholder(templateContents []byte, templateFilename, imageName,
+	placeholderString string, ephemeral bool) ([]byte, error) {
 
 	// Check if the placeholder is explicitly specified on the command line.
 	placeholder := []byte(placeholderString)
 
 	if len(placeholder) != 0 {
 		if !bytes.Contains(templateContents, placeholder) {
-			return fmt.Errorf(
+			return nil, fmt.Errorf(
 				"'%s' does not contain occurrences of '%s'",
 				templateFilename, placeholderString)
 		}
-	} else {
-		// Use the image name itself as the placeholder.
-		re := regexp.MustCompile(regexp.QuoteMeta(imageName) +
-			// Image tag may contain lowercase and uppercase
-			// letters, digits, underscores, periods, and dashes.
-			"(?::[-.\\w]+)?")
+		return placeholder, nil
+	}
+
+	// Use the image name itself as the placeholder.
+	// Image tag may contain lowercase and uppercase
+	// letters, digits, underscores, periods, and dashes.
+	refPattern := "(?::[-.\\w]+)?"
+	if ephemeral {
+		refPattern = ephemeralRefPattern
+	}
+	// References by digest, as written with '-digest', are matched
+	// as well.
+	re := regexp.MustCompile(regexp.QuoteMeta(imageName) + refPattern +
+		"(?:@sha256:[0-9a-f]{64})?")
+
+	imageRefs := re.FindAll(templateContents, -1)
 
-		imageRefs := re.FindAll(templateContents, -1)
+	if len(imageRefs) == 0 {
+		return nil, fmt.Errorf(
+			"'%s' does not contain references to '%s'",
+			templateFilename, imageName)
+	}
+
+	placeholder = imageRefs[0]
 
-		if len(imageRefs) == 0 {
-			return fmt.Errorf(
-				"'%s' does not contain references to '%s'",
+	// Check that all references to the image within the template
+	// file are identical.
+	for i := 1; i < len(imageRefs); i++ {
+		if bytes.Compare(imageRefs[i], placeholder) != 0 {
+			return nil, fmt.Errorf("'%s' contains "+
+				"inconsistent references to '%s'",
 				templateFilename, imageName)
 		}
+	}
 
-		placeholder = imageRefs[0]
+	return placeholder, nil
+}
 
-		// Check that all references to the image within the template
-		// file are identical.
-		for i := 1; i < len(imageRefs); i++ {
-			if bytes.Compare(imageRefs[i], placeholder) != 0 {
-				return fmt.Errorf("'%s' contains "+
-					"inconsistent references to '%s'",
-					templateFilename, imageName)
-			}
+// buildAndPushImage builds the image and pushes it to the container
+// registry. With '-buildx-push', the image is pushed by buildx directly
+// from the builder, along with the additional tags, in a single step, and
+// the manifest digest reported by buildx is returned; otherwise, the
+// returned digest is empty, and the tags are not pushed.
+func buildAndPushImage(workingDir, imageName, fingerprint string,
+	taggedNames []string, opts *options) (string, error) {
+	if err := lintDockerfile(
+		workingDir, opts.dockerfile, opts.lintMode); err != nil {
+		return "", err
+	}
+
+	if len(opts.ssh) != 0 {
+		if err := checkSSHSpecs(opts.ssh); err != nil {
+			return "", err
+		}
+	}
+	// SSH forwarding and secrets are only available with BuildKit.
+	if (len(opts.ssh) != 0 || len(opts.secrets) != 0) &&
+		os.Getenv("DOCKER_BUILDKIT") == "" {
+		os.Setenv("DOCKER_BUILDKIT", "1")
+	}
+
+	args := []string{"build", workingDir, "-t", imageName}
+	if opts.buildxPush {
+		for _, taggedName := range taggedNames {
+			args = append(args, "-t", taggedName)
+		}
+		args = buildxArgs(opts, args...)
+		if opts.insecureHosts[imageRegistry(imageName, opts)] {
+			args = append(args, "--output", "type=image,"+
+				"push=true,registry.insecure=true")
+		} else {
+			args = append(args, "--push")
+		}
+	} else if opts.buildxBuilder != "" {
+		// The image built by the selected builder instance, which may
+		// be remote, is loaded into the local image store to be pushed.
+		args = append(buildxArgs(opts, args...), "--load")
+	}
+	if opts.quiet {
+		args = append(args, "-q")
+	}
+	if opts.dockerfile != "" {
+		args = append(args, "-f", opts.dockerfile)
+	}
+	if opts.target != "" {
+		args = append(args, "--target", opts.target)
+	}
+	if len(opts.platforms) != 0 {
+		args = append(args, "--platform",
+			strings.Join(opts.platforms, ","))
+	}
+	for _, context := range opts.buildContexts {
+		args = append(args, "--build-context", context)
+	}
+	for _, buildArg := range opts.buildArgs {
+		// Secret values and the values read from files are passed
+		// through the environment to keep them out of the command line
+		// and the printed command.
+		parts := strings.SplitN(buildArg, "=", 2)
+		if len(parts) == 2 && (opts.secretArgs[parts[0]] ||
+			opts.argFiles[parts[0]] != "") {
+			os.Setenv(parts[0], parts[1])
+			buildArg = parts[0]
+		}
+		args = append(args, "--build-arg", buildArg)
+	}
+	for _, spec := range opts.ssh {
+		args = append(args, "--ssh", spec)
+	}
+	for _, spec := range opts.secrets {
+		args = append(args, "--secret", spec)
+	}
+	for _, cache := range opts.cacheFrom {
+		args = append(args, "--cache-from", cache)
+	}
+	for _, cache := range opts.cacheTo {
+		args = append(args, "--cache-to", cache)
+	}
+	if !opts.noAutoCache && buildTool == "docker" {
+		// The image of the previous fingerprint is used as the cache,
+		// unless the cache is configured explicitly.
+		if previous := previousImage(imageName, opts); previous != "" &&
+			len(opts.cacheFrom) == 0 {
+			args = append(args, "--cache-from", previous)
 		}
 	}
+	if opts.inlineCache && buildTool == "docker" {
+		// The image embeds the cache metadata to serve as the cache
+		// for the next fingerprint.
+		args = append(args, "--build-arg", "BUILDKIT_INLINE_CACHE=1")
+	}
+	if opts.provenance != "" {
+		args = append(args, "--provenance="+opts.provenance)
+	}
+	if opts.sbom != "" {
+		args = append(args, "--sbom="+opts.sbom)
+	}
+	args = append(args, opts.buildFlags...)
+	args = append(args, "--label", fingerprintLabel+"="+fingerprint)
+	if opts.fingerprint != "" {
+		// Record that the tag was not computed from the sources.
+		args = append(args, "--label",
+			"docker-reuse.fingerprint-source=external")
+	}
+	if opts.injectArgs {
+		// These build arguments are not part of the fingerprint.
+		args = append(args, "--build-arg",
+			"DOCKER_REUSE_FINGERPRINT="+fingerprint)
+		if commit, err := getHeadCommit(workingDir); err == nil {
+			args = append(args,
+				"--build-arg", "DOCKER_REUSE_COMMIT="+commit,
+				"--label", "docker-reuse.commit="+commit)
+		}
+	}
+
+	if opts.buildxPush {
+		return buildxBuildAndPush(args, opts.quiet)
+	}
 
-	fingerprint, err := computeFingerprint(
-		workingDir, dockerfile, buildArgs, quiet)
+	buildStart := time.Now()
+	if err := runDockerCmd(opts.quiet, args...); err != nil {
+		return "", err
+	}
+	buildDuration := time.Since(buildStart).Round(time.Second)
+
+	// The duration is only known after the build, so it is added
+	// to the image by a trivial second build on top of it.
+	if err := labelImage(imageName, buildDurationLabel,
+		buildDuration.String()); err != nil {
+		return "", err
+	}
+
+	args = []string{"push", imageName}
+	if opts.quiet {
+		args = append(args, "-q")
+	}
+	return "", withRetries(opts, "pushing "+imageName, func() error {
+		return runDockerCmd(opts.quiet, args...)
+	})
+}
+
+// buildxBuildAndPush runs the 'docker buildx build --push' command and
+// returns the digest of the pushed manifest.
+func buildxBuildAndPush(args []string, quiet bool) (string, error) {
+	metadataFile, err := ioutil.TempFile("", "docker-reuse-metadata-*")
 	if err != nil {
-		return err
+		return "", err
 	}
+	metadataFile.Close()
+	defer os.Remove(metadataFile.Name())
 
-	imageName = imageName + ":" + fingerprint
-	if !quiet {
+	args = append(args, "--metadata-file", metadataFile.Name())
+	if err = runDockerCmd(quiet, args...); err != nil {
+		return "", err
+	}
+
+	contents, err := ioutil.ReadFile(metadataFile.Name())
+	if err != nil {
+		return "", err
+	}
+
+	var metadata struct {
+		Digest string `json:"containerimage.digest"`
+	}
+	if err = json.Unmarshal(contents, &metadata); err != nil {
+		return "", fmt.Errorf("unable to parse buildx metadata: %v", err)
+	}
+	if metadata.Digest == "" {
+		return "", errors.New("buildx did not report the image digest")
+	}
+
+	return metadata.Digest, nil
+}
+
+// labelImage replaces the local image with a copy that has the
+// given label set.
+func labelImage(imageName, label, value string) error {
+	args := []string{"build", "-q", "-t", imageName,
+		"--label", label + "=" + value}
+	if buildTool == "docker" {
+		args = append(args, "-")
+	} else {
+		// The other build tools only read the Dockerfile from the
+		// standard input with '-f -', which needs a build context.
+		emptyDir, err := ioutil.TempDir("", "docker-reuse-label-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(emptyDir)
+		args = append(args, "-f", "-", emptyDir)
+	}
+	cmd := exec.Command(buildTool, args...)
+	cmd.Stdin = strings.NewReader("FROM " + imageName + "\n")
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// getSavedDuration returns the build duration recorded in the labels
+// of the existing image, which is the time saved by reusing it. The
+// images pushed by buildx cannot be labeled after the build, so their
+// build duration is looked up in the state file instead.
+func getSavedDuration(imageName string,
+	opts *options) (time.Duration, error) {
+
+	labels, err := getImageLabels(imageName, opts)
+	if err != nil {
+		return 0, err
+	}
+	value, ok := labels[buildDurationLabel]
+	if !ok {
+		if build, ok := recordedBuild(imageName, opts); ok {
+			return time.Duration(build.Seconds *
+				float64(time.Second)).Round(time.Second), nil
+		}
+		return 0, fmt.Errorf("'%s' does not have the '%s' label",
+			imageName, buildDurationLabel)
+	}
+	return time.ParseDuration(value)
+}
+
+// findOrBuildAndPushImage finds the image with the fingerprint tag,
+// building and pushing the image if it does not exist.
+// Unless templateFilename is empty, the image reference in the template
+// file is updated to point to the returned image.
+func findOrBuildAndPushImage(workingDir, imageName, templateFilename string,
+	opts *options) (*imageResult, error) {
+
+	var templateContents, placeholder []byte
+
+	if opts.ecr {
+		if repo := parseECRRepository(imageName, opts); repo != nil {
+			creds, err := ecrCredentials(repo)
+			if err != nil {
+				return nil, err
+			}
+			opts.credentials = creds
+		}
+	}
+
+	if opts.gar {
+		if registry := googleRegistry(imageName, opts); registry != "" {
+			creds, err := googleCredentials(registry)
+			if err != nil {
+				return nil, err
+			}
+			opts.credentials = creds
+		}
+	}
+
+	if opts.acr {
+		if registry := acrRegistry(imageName, opts); registry != "" {
+			creds, err := acrCredentials(registry)
+			if err != nil {
+				return nil, err
+			}
+			opts.credentials = creds
+		}
+	}
+
+	// The explicitly given credentials are for the registry of the
+	// target image (the first one with '-from-skaffold').
+	registry := imageRegistry(imageName, opts)
+	if opts.credentials != nil && opts.credentials.registry == "" {
+		opts.credentials.registry = registry
+	}
+	if opts.credentials != nil && opts.credentials.registry == registry {
+		if err := dockerLogin(imageName, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	if templateFilename != "" {
+		var err error
+
+		templateContents, err = ioutil.ReadFile(templateFilename)
+		if err != nil {
+			return nil, err
+		}
+
+		// Replacing strings in a binary file, such as a build
+		// artifact passed by mistake, would corrupt it.
+		if !opts.allowBinary &&
+			bytes.IndexByte(templateContents, 0) >= 0 {
+			return nil, fmt.Errorf("'%s' appears to be a binary "+
+				"file; use -allow-binary-templates to update it "+
+				"anyway", templateFilename)
+		}
+
+		if opts.format == "nomad" {
+			// Check that the job file can be updated before
+			// building the image.
+			_, err = updateNomadJob(templateContents,
+				templateFilename, imageName, opts.placeholder,
+				imageName)
+		} else {
+			placeholder, err = findPlaceholder(templateContents,
+				templateFilename, imageName, opts.placeholder,
+				opts.ephemeral != 0)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var fingerprintDuration time.Duration
+	var bytesHashed int64
+
+	fingerprint := opts.fingerprint
+	fingerprintSource := "computed"
+	if fingerprint != "" {
+		fingerprintSource = "external"
+		if !opts.quiet {
+			fmt.Println("Fingerprint:", fingerprint,
+				"(supplied externally)")
+		}
+	} else {
+		fingerprintStart := time.Now()
+		var err error
+		fingerprint, err = computeFingerprint(
+			workingDir, opts, &bytesHashed)
+		if err != nil {
+			return nil, err
+		}
+		fingerprintDuration = time.Since(fingerprintStart)
+	}
+
+	result := &imageResult{Fingerprint: fingerprint,
+		FingerprintSource: fingerprintSource, Decision: "reused",
+		FingerprintSeconds: fingerprintDuration.Seconds(),
+		BytesHashed:        bytesHashed}
+
+	if opts.ephemeral != 0 {
+		imageName = ephemeralImageName(
+			imageName, fingerprint, opts.ephemeral)
+	} else {
+		imageName = imageName + ":" + fingerprint
+	}
+	if !opts.quiet {
 		fmt.Println("Target image:", imageName)
 	}
 
-	// Check if the image already exists in the registry
-	err = runDockerCmd(true, "manifest", "inspect", imageName)
-	if err == nil {
-		if !quiet {
-			fmt.Println("Image already exists")
+	// found tells whether the image exists, even if it is not reused.
+	var exists, found bool
+	var mirrorName string
+	var taggedNames []string
+
+	if opts.forceRebuild {
+		if opts.immutableTags {
+			// The fingerprint tag cannot be overwritten, so push
+			// the rebuilt image under the next free revision tag.
+			_, nextRevision, err := imageRevisions(imageName, opts)
+			if err != nil {
+				return nil, err
+			}
+			imageName = nextRevision
+			if !opts.quiet {
+				fmt.Println("Rebuilding as:", imageName)
+			}
+		} else if !opts.quiet {
+			fmt.Println("Forcing rebuild")
 		}
 	} else {
-		// If the above command exited with a non-zero code, assume
-		// that the image does not exist. Abort on all other errors.
-		if _, ok := err.(*exec.ExitError); !ok {
-			return err
+		var err error
+		if exists, err = imageExists(imageName, opts); err != nil {
+			return nil, err
+		}
+		if exists && opts.immutableTags {
+			// Reuse the image from the latest forced rebuild,
+			// which could not overwrite the fingerprint tag.
+			if imageName, _, err = imageRevisions(
+				imageName, opts); err != nil {
+				return nil, err
+			}
+			if !opts.quiet && !strings.HasSuffix(imageName,
+				":"+fingerprint) {
+				fmt.Println("Latest revision:", imageName)
+			}
+		}
+		found = exists
+		if exists && opts.verifyReuse != "" {
+			if exists, err = checkReusedImage(
+				imageName, fingerprint, opts); err != nil {
+				return nil, err
+			}
+		}
+		if exists && len(opts.platforms) != 0 {
+			if exists, err = checkImagePlatforms(
+				imageName, opts); err != nil {
+				return nil, err
+			}
+		}
+		if exists && opts.ephemeral != 0 {
+			expiring, err := expiresSoon(imageName, opts)
+			if err != nil {
+				return nil, err
+			}
+			if expiring {
+				if !opts.quiet {
+					fmt.Println("Image may expire soon, " +
+						"pushing it again")
+				}
+				exists = false
+			}
+		}
+		if !exists {
+			mirrorName = findInMirrors(imageName, opts)
+			if mirrorName != "" && !opts.quiet {
+				fmt.Println("Found in another registry:",
+					mirrorName)
+			}
+		}
+	}
+
+	if opts.dryRun {
+		result.Image = imageName
+		result.Decision = "would reuse"
+		if mirrorName != "" {
+			result.Decision = "would copy"
+		} else if !exists {
+			result.Decision = "would build"
 		}
 
-		// Build the image and push it to the container registry.
+		if err := reportRegistryImpact(imageName, mirrorName,
+			fingerprint, exists, opts); err != nil {
+			return nil, err
+		}
 
-		args := []string{"build", ".", "-t", imageName}
-		if quiet {
-			args = append(args, "-q")
+		if templateFilename != "" && opts.format == "nomad" {
+			fmt.Printf("Would update the task configs in '%s' "+
+				"to use %s\n", templateFilename, imageName)
+		} else if templateFilename != "" &&
+			bytes.Compare(placeholder, []byte(imageName)) != 0 {
+			fmt.Printf("Would update '%s': %s -> %s\n",
+				templateFilename, placeholder, imageName)
 		}
-		if dockerfile != "" {
-			args = append(args, "-f", dockerfile)
+
+		return result, nil
+	}
+
+	// With '-lock', only one of the concurrent runs builds the image,
+	// and the others reuse it once it is pushed. '-wait-for-existing'
+	// makes a run wait for a concurrent build even without '-lock'.
+	// An existing image that has been rejected is rebuilt right away.
+	if !exists && !found && mirrorName == "" && !opts.noBuild &&
+		!opts.forceRebuild && (opts.lockTTL != 0 || opts.waitTimeout != 0) {
+		lock, appeared, err := acquireBuildLock(imageName, opts)
+		if err != nil {
+			return nil, err
 		}
-		for _, buildArg := range buildArgs {
-			args = append(args, "--build-arg", buildArg)
+		if lock != nil {
+			defer lock.release(opts)
 		}
-		if err = runDockerCmd(quiet, args...); err != nil {
-			return err
+		exists = appeared
+	}
+
+	// An image found in another registry is copied to the target
+	// repository and then treated the same as an existing one.
+	if mirrorName != "" {
+		if err := prepareRepository(imageName, opts); err != nil {
+			return nil, err
+		}
+		if err := copyImage(mirrorName, imageName, opts); err != nil {
+			return nil, err
 		}
+		if !opts.quiet {
+			fmt.Println("Copied:", mirrorName, "->", imageName)
+		}
+	}
 
-		args = []string{"push", imageName}
-		if quiet {
-			args = append(args, "-q")
+	if exists || mirrorName != "" {
+		var saved time.Duration
+		if !opts.quiet || opts.resolveDigest {
+			// Images built by older versions or pushed by
+			// buildx on another machine have no recorded
+			// duration, in which case the estimate is omitted.
+			saved, _ = getSavedDuration(imageName, opts)
+			result.SavedSeconds = saved.Seconds()
 		}
-		if err = runDockerCmd(quiet, args...); err != nil {
-			return err
+		if !opts.quiet {
+			if saved != 0 {
+				fmt.Printf("Image already exists (saved ~%s)\n",
+					saved)
+			} else {
+				fmt.Println("Image already exists")
+			}
+		}
+	} else if opts.noBuild {
+		return nil, fmt.Errorf("%w: %s", errImageNotFound, imageName)
+	} else {
+		if err := prepareRepository(imageName, opts); err != nil {
+			return nil, err
+		}
+		// buildx pushes the additional tags along with the image.
+		if opts.buildxPush {
+			var err error
+			if taggedNames, err = selectTags(imageName, fingerprint,
+				true, true, opts); err != nil {
+				return nil, err
+			}
+		}
+		buildStart := time.Now()
+		digest, err := buildAndPushImage(
+			workingDir, imageName, fingerprint, taggedNames, opts)
+		if err != nil {
+			return nil, err
+		}
+		result.Decision = "built"
+		result.ForcedRebuild = opts.forceRebuild
+		result.Digest = digest
+		result.BuildSeconds = time.Since(buildStart).Seconds()
+	}
+
+	result.Image = imageName
+
+	if result.Decision != "built" || !opts.buildxPush {
+		var err error
+		if taggedNames, err = applyAdditionalTags(imageName, fingerprint,
+			result.Decision == "built", opts); err != nil {
+			return nil, err
 		}
 	}
 
-	newImageRef := []byte(imageName)
+	if err := pushToMirrors(imageName, taggedNames, opts); err != nil {
+		return nil, err
+	}
+
+	if opts.resolveDigest && result.Digest == "" {
+		digest, err := getImageDigest(imageName, opts)
+		if err != nil {
+			return nil, err
+		}
+		result.Digest = digest
+	}
+
+	newImageRef := imageName
+	if opts.digestRefs {
+		newImageRef = repositoryName(imageName) + "@" + result.Digest
+		if !opts.quiet {
+			fmt.Println("Image reference:", newImageRef)
+		}
+	}
+
+	if templateFilename != "" && opts.format == "nomad" {
+		newContents, err := updateNomadJob(templateContents,
+			templateFilename, repositoryName(imageName),
+			opts.placeholder, newImageRef)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(newContents, templateContents) {
+			return result, nil
+		}
+		return result, updateTemplateFile(result, templateFilename,
+			templateContents, newContents, opts)
+	}
 
 	// No need to update the output file if it already contains
 	// the right reference.
-	if bytes.Compare(placeholder, newImageRef) == 0 {
-		return nil
+	if templateFilename == "" ||
+		bytes.Compare(placeholder, []byte(newImageRef)) == 0 {
+		return result, nil
 	}
 
-	return ioutil.WriteFile(templateFilename,
-		bytes.ReplaceAll(templateContents, placeholder, newImageRef), 0)
+	return result, updateTemplateFile(result, templateFilename,
+		templateContents, bytes.ReplaceAll(templateContents,
+			placeholder, []byte(newImageRef)), opts)
+}
+
+// errImageNotFound is returned when the image does not exist and
+// building it is not allowed.
+var errImageNotFound = errors.New("image does not exist and -no-build is set")
+
+// exitImageNotFound is the exit code that signals errImageNotFound.
+const exitImageNotFound = 3
+
+func exitWithError(err error) {
+	fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	if errors.Is(err, errImageNotFound) {
+		os.Exit(exitImageNotFound)
+	}
+	os.Exit(1)
 }
 
-var usage = `Usage:  docker-reuse [OPTIONS] PATH IMAGE FILE [ARG...]
+// flagOrEnv returns the value of the option or, if it is not set, the
+// value of the environment variable.
+func flagOrEnv(value, variable string) string {
+	if value != "" {
+		return value
+	}
+	return os.Getenv(variable)
+}
+
+// parsePlatforms splits the value of the '-platform' option into a sorted
+// list of unique platforms, so that the order in which they are given does
+// not affect the fingerprint.
+func parsePlatforms(value string) []string {
+	seen := map[string]bool{}
+	var platforms []string
+	for _, platform := range strings.Split(value, ",") {
+		platform = strings.ToLower(strings.TrimSpace(platform))
+		if platform != "" && !seen[platform] {
+			seen[platform] = true
+			platforms = append(platforms, platform)
+		}
+	}
+	sort.Strings(platforms)
+	return platforms
+}
+
+// validTag matches the image tags accepted by docker: up to 128 letters,
+// digits, underscores, periods, and dashes, not starting with a period
+// or a dash.
+var validTag = regexp.MustCompile(`^\w[-.\w]{0,127}$`)
+
+var usage = `Usage:  docker-reuse [OPTIONS] PATH IMAGE FILE [ARG...] [-- FLAG...]
+        docker-reuse [OPTIONS] -from-skaffold SKAFFOLD_YAML [FILE] [-- FLAG...]
+        docker-reuse [OPTIONS] emit-make PATH IMAGE FILE [ARG...] [-- FLAG...]
+        docker-reuse [OPTIONS] stats [text|json]
+        docker-reuse [OPTIONS] selftest
 
 Arguments:
   PATH
@@ -141,6 +873,8 @@ Arguments:
     	File to update with the new image tag
   [ARG...]
     	Optional build arguments (format: NAME[=value])
+  [FLAG...]
+    	Additional flags passed to the build command as is
 
 Options:`
 
@@ -154,6 +888,264 @@ func main() {
 		"Placeholder for the image name in FILE "+
 			"(by default, the image name itself)")
 
+	var lintFlag = flag.String("lint", "off",
+		"Check the Dockerfile before building (`warn|error|off`)")
+
+	var sshFlag stringList
+	flag.Var(&sshFlag, "ssh", "SSH agent socket or keys to expose "+
+		"to the build (format: `default|id[=path,...]`)")
+
+	var cacheFromFlag stringList
+	flag.Var(&cacheFromFlag, "cache-from", "External cache `source` "+
+		"for the build (passed to --cache-from; can be repeated)")
+
+	var cacheToFlag stringList
+	flag.Var(&cacheToFlag, "cache-to", "Cache export `destination` "+
+		"for the build (passed to --cache-to; can be repeated)")
+
+	var hashFlagsFlag = flag.Bool("fingerprint-build-flags", false,
+		"Include the build flags given after '--' in the fingerprint")
+
+	var noAutoCacheFlag = flag.Bool("no-auto-cache", false,
+		"Do not use the previously built image of the repository "+
+			"as the build cache")
+
+	var inlineCacheFlag = flag.Bool("inline-cache", false,
+		"Embed the build cache metadata in the image "+
+			"(BUILDKIT_INLINE_CACHE=1) for use by the next builds")
+
+	var skaffoldFlag = flag.String("from-skaffold", "",
+		"Find or build the artifacts defined in `skaffold.yaml`")
+
+	var skaffoldOutputFlag = flag.String("skaffold-output", "",
+		"Write the resulting image references to a `JSON` file "+
+			"for 'skaffold deploy --build-artifacts'")
+
+	var fingerprintFlag = flag.String("fingerprint", "",
+		"Use this `tag` instead of computing the fingerprint")
+
+	var forceRebuildFlag = flag.Bool("force-rebuild", false,
+		"Build and push the image even if it already exists")
+
+	var immutableTagsFlag = flag.Bool("immutable-tags", false,
+		"With -force-rebuild, push under a new '-rN' revision tag "+
+			"instead of overwriting the fingerprint tag; reuse the "+
+			"latest revision")
+
+	var modeFlag = flag.String("m", "commit",
+		"Fingerprinting `mode`: 'commit', 'commit-dirty', 'tree', "+
+			"'sha1', 'sha256', 'blake3', or 'exec:COMMAND'")
+
+	var dumpInputFlag = flag.String("dump-fingerprint-input", "",
+		"Write the data that the fingerprint is computed from to `file`")
+
+	var ephemeralFlag = flag.Duration("ephemeral", 0,
+		"Push to a ttl.sh-style registry with the `TTL` as the tag "+
+			"and the fingerprint in the repository name")
+
+	var lockFlag = flag.Duration("lock", 0,
+		"Let only one of the concurrent runs build the image, "+
+			"treating a lock older than `duration` as abandoned")
+
+	var waitFlag = flag.Duration("wait-for-existing", 0,
+		"Wait up to `TIMEOUT` for the image being built "+
+			"by a concurrent run instead of building it again")
+
+	var noBuildFlag = flag.Bool("no-build", false,
+		"Fail with exit code 3 instead of building "+
+			"if the image does not exist")
+
+	var auditLogFlag = flag.String("audit-log", "",
+		"Append a JSON record describing this run to `file`")
+
+	var attestDecisionFlag = flag.String("attest-decision", "",
+		"Write a signed in-toto statement explaining "+
+			"the reuse decision to `file`")
+
+	var envFileFlag stringList
+	flag.Var(&envFileFlag, "env-file", "Read build arguments "+
+		"from a `file` of NAME=value lines (can be repeated)")
+
+	var secretArgFlag stringList
+	flag.Var(&secretArgFlag, "secret-arg", "Build argument `name` whose "+
+		"value must not be printed (can be repeated)")
+
+	var ignoreArgFlag stringList
+	flag.Var(&ignoreArgFlag, "ignore-arg", "Build argument `name` to "+
+		"leave out of the fingerprint (can be repeated)")
+
+	var secretFlag stringList
+	flag.Var(&secretFlag, "secret", "Secret to expose to the build "+
+		"(format: `id=ID[,src=PATH|,env=VAR]`; can be repeated)")
+
+	var ignoreSecretFlag stringList
+	flag.Var(&ignoreSecretFlag, "ignore-secret", "`ID` of the secret "+
+		"to leave out of the fingerprint (can be repeated)")
+
+	var strictArgsFlag = flag.Bool("strict-args", false,
+		"Fail if a build argument is not declared in the Dockerfile")
+
+	var tagFlag stringList
+	flag.Var(&tagFlag, "t", "Additional `tag` to apply to the image "+
+		"(can be repeated)")
+
+	var noSanitizeTagsFlag = flag.Bool("no-sanitize-tags", false,
+		"Reject invalid additional tags instead of sanitizing them")
+
+	var tagsOnReuseFlag = flag.String("tags-on-reuse", "always",
+		"Whether to apply additional tags when the image is reused: "+
+			"`never|always|if-missing`")
+
+	var forceTagMoveFlag = flag.Bool("force-tag-move", false,
+		"Allow moving additional tags that point to an image "+
+			"with a different fingerprint")
+
+	var dryRunFlag = flag.Bool("dry-run", false,
+		"Report the registry changes that would be made "+
+			"without building, pushing, or updating FILE")
+
+	var trackedOnlyFlag = flag.Bool("tracked-only", false,
+		"Hash only the files tracked by git when hashing "+
+			"source contents")
+
+	var stateFileFlag = flag.String("state-file", defaultStateFile(),
+		"`Pathname` of the file that keeps reuse statistics "+
+			"between runs (empty to disable)")
+
+	var verifyReuseFlag = flag.String("verify-reuse", "",
+		"Check that a reused image has not been replaced and, if it "+
+			"has, fail or rebuild it (`error|rebuild`)")
+
+	var metricsPushFlag = flag.String("metrics-push", "",
+		"Push the run metrics to the Prometheus Pushgateway at `URL`")
+
+	var noGitignoreFlag = flag.Bool("no-gitignore", false,
+		"Do not skip files ignored by .gitignore when hashing "+
+			"source contents")
+
+	var excludeFlag stringList
+	flag.Var(&excludeFlag, "x", "Exclude files matching the `pattern` "+
+		"(.gitignore syntax) from the fingerprint (can be repeated)")
+
+	var buildxPushFlag = flag.Bool("buildx-push", false,
+		"Build with 'docker buildx build --push', bypassing "+
+			"the local image store (default if buildx is available)")
+
+	var buildxBuilderFlag = flag.String("buildx-builder", "",
+		"Run the buildx commands on the builder instance `NAME`")
+
+	var builderFlag = flag.String("builder", "docker",
+		"Command that builds and pushes the images "+
+			"(`docker|podman|buildah|nerdctl`)")
+
+	var provenanceFlag = flag.String("provenance", "",
+		"Provenance attestation `setting` passed to the build "+
+			"(for example, 'false' or 'mode=max')")
+
+	var sbomFlag = flag.String("sbom", "",
+		"SBOM attestation `setting` passed to the build "+
+			"(for example, 'false' or 'true')")
+
+	var urlModeFlag = flag.String("url-mode", "etag",
+		"How to fingerprint the files that ADD downloads: "+
+			"`etag|last-modified|content`")
+
+	var injectFingerprintFlag = flag.Bool("inject-fingerprint", false,
+		"Pass the fingerprint and the git commit to the build as "+
+			"DOCKER_REUSE_FINGERPRINT and DOCKER_REUSE_COMMIT")
+
+	var platformFlag = flag.String("platform", "",
+		"Target `platforms` of the build (comma-separated, "+
+			"for example, 'linux/amd64,linux/arm64')")
+
+	var targetFlag = flag.String("target", "",
+		"Build the specified `stage` of the Dockerfile")
+
+	var buildContextFlag stringList
+	flag.Var(&buildContextFlag, "build-context", "Additional build "+
+		"context (format: `name=path`; can be repeated)")
+
+	var alsoCheckFlag stringList
+	flag.Var(&alsoCheckFlag, "also-check", "Reuse the image if it exists "+
+		"in this `registry/namespace`, copying it (can be repeated)")
+
+	var mirrorFlag stringList
+	flag.Var(&mirrorFlag, "mirror", "Also push the image and its tags "+
+		"to this `registry/namespace` (can be repeated)")
+
+	var pinBaseFlag = flag.Bool("pin-base", false,
+		"Include the digests of the base images in the fingerprint")
+
+	var changedFilesFlag = flag.String("changed-files", "",
+		"Write the list of updated template files with their hashes "+
+			"before and after the update to a JSON `file`")
+
+	var digestFlag = flag.Bool("digest", false,
+		"Refer to the image by digest (IMAGE@sha256:...) in FILE "+
+			"instead of by the fingerprint tag")
+
+	var refFileFlag = flag.String("ref-file", "",
+		"Write the digest reference of the image (repo@sha256:...) "+
+			"to `file`")
+
+	var postUpdateFlag = flag.String("post-update-format", "",
+		"Shell `command` to run on FILE after updating it, such as "+
+			"a formatter; '{}' stands for the pathname")
+
+	var retriesFlag = flag.Int("retries", 3,
+		"Number of times to retry a failed registry operation")
+
+	var retryDelayFlag = flag.Duration("retry-delay", time.Second,
+		"Delay before the first retry, doubled for each next one")
+
+	var insecureRegistryFlag stringList
+	flag.Var(&insecureRegistryFlag, "insecure-registry", "Access the "+
+		"registry `host[:port]` over plain HTTP or without verifying "+
+		"its TLS certificate (can be repeated)")
+
+	var registryCAFlag = flag.String("registry-ca", "",
+		"PEM `file` with additional CA certificates for the registry "+
+			"(default $DOCKER_REUSE_REGISTRY_CA)")
+
+	var proxyFlag = flag.String("proxy", "",
+		"Send the registry API requests through the proxy at `URL` "+
+			"(default $HTTPS_PROXY)")
+
+	var ecrFlag = flag.Bool("ecr", false,
+		"Log in to Amazon ECR registries using the AWS CLI and "+
+			"check that the repository exists before pushing")
+
+	var garFlag = flag.Bool("gar", false,
+		"Authenticate to Google Artifact Registry and Container "+
+			"Registry using Application Default Credentials")
+
+	var acrFlag = flag.Bool("acr", false,
+		"Authenticate to Azure Container Registry using the service "+
+			"principal or the managed identity")
+
+	var createNamespaceFlag = flag.String("create-namespace", "",
+		"Create the Harbor project or the Quay repository with the "+
+			"given `visibility` (public|private) before the first push")
+
+	var registryUserFlag = flag.String("registry-user", "",
+		"User `name` for the registry "+
+			"(default $DOCKER_REUSE_REGISTRY_USER)")
+
+	var registryPasswordFlag = flag.String("registry-password", "",
+		"`Password` for the registry "+
+			"(default $DOCKER_REUSE_REGISTRY_PASSWORD)")
+
+	var registryTokenFlag = flag.String("registry-token", "",
+		"Access `token` for the registry "+
+			"(default $DOCKER_REUSE_REGISTRY_TOKEN)")
+
+	var allowBinaryFlag = flag.Bool("allow-binary-templates", false,
+		"Allow updating FILE even if it contains NUL bytes")
+
+	var formatFlag = flag.String("format", "text",
+		"Format of FILE: 'text' or 'nomad' "+
+			"(update the task configs of a Nomad job)")
+
 	flag.Usage = func() {
 		fmt.Fprintln(flag.CommandLine.Output(), usage)
 		flag.PrintDefaults()
@@ -163,29 +1155,521 @@ func main() {
 
 	args := flag.Args()
 
-	if len(args) < 3 {
+	// The arguments after '--' are passed to the build command as is.
+	var buildFlags []string
+	dashes := false
+	for i, arg := range args {
+		if arg == "--" {
+			buildFlags = args[i+1:]
+			args = args[:i]
+			dashes = true
+			break
+		}
+	}
+
+	if len(args) > 0 && len(args) <= 2 && args[0] == "stats" {
+		format := "text"
+		if len(args) == 2 {
+			format = args[1]
+		}
+		if err := printStats(os.Stdout,
+			*stateFileFlag, format); err != nil {
+			exitWithError(err)
+		}
+		return
+	}
+
+	if len(args) == 1 && args[0] == "selftest" {
+		if err := runSelfTest(*quietFlag); err != nil {
+			exitWithError(err)
+		}
+		return
+	}
+
+	// The emit-make command takes the same arguments as a regular run.
+	emitMake := len(args) > 0 && args[0] == "emit-make"
+	if emitMake {
+		args = args[1:]
+		if *skaffoldFlag != "" {
+			fmt.Fprintln(flag.CommandLine.Output(),
+				"emit-make cannot be used with -from-skaffold")
+			flag.Usage()
+			os.Exit(2)
+		}
+	}
+
+	if *skaffoldFlag != "" && *dumpInputFlag != "" {
+		fmt.Fprintln(flag.CommandLine.Output(), "-dump-fingerprint-input "+
+			"cannot be used with -from-skaffold")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *skaffoldOutputFlag != "" && *skaffoldFlag == "" {
+		fmt.Fprintln(flag.CommandLine.Output(),
+			"-skaffold-output requires -from-skaffold")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *skaffoldFlag != "" && len(envFileFlag) > 0 {
+		fmt.Fprintln(flag.CommandLine.Output(),
+			"-env-file cannot be used with -from-skaffold")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *skaffoldFlag != "" {
+		if len(args) > 1 {
+			fmt.Fprintln(flag.CommandLine.Output(),
+				"invalid number of positional arguments")
+			flag.Usage()
+			os.Exit(2)
+		}
+	} else if len(args) < 3 {
 		fmt.Fprintln(flag.CommandLine.Output(),
 			"invalid number of positional arguments")
 		flag.Usage()
 		os.Exit(2)
 	}
 
-	buildArgs := args[3:]
+	if err := checkLintMode(*lintFlag); err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		flag.Usage()
+		os.Exit(2)
+	}
 
-	// Load any missing build argument values from the respective
-	// environment variables.  This job cannot be left to docker
-	// because argument values are part of the image fingerprint.
-	for i, arg := range buildArgs {
-		if !strings.ContainsRune(arg, '=') {
-			buildArgs[i] = arg + "=" + os.Getenv(arg)
+	for _, context := range buildContextFlag {
+		if name, value := splitBuildContext(context); name == "" ||
+			value == "" {
+			fmt.Fprintf(flag.CommandLine.Output(),
+				"invalid build context '%s'\n", context)
+			flag.Usage()
+			os.Exit(2)
 		}
 	}
 
-	if err := findOrBuildAndPushImage(args[0], args[1], args[2],
-		*imagePlaceholderFlag, *dockerfileFlag,
-		buildArgs, *quietFlag); err != nil {
+	if err := checkFormat(*formatFlag); err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := checkBuilder(*builderFlag); err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *builderFlag != "docker" && (*buildxPushFlag ||
+		*buildxBuilderFlag != "" || *provenanceFlag != "" ||
+		*sbomFlag != "") {
+		fmt.Fprintln(flag.CommandLine.Output(), "-buildx-push, "+
+			"-buildx-builder, -provenance, and -sbom "+
+			"require -builder docker")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	buildTool = *builderFlag
 
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+	if len(parsePlatforms(*platformFlag)) > 1 && *builderFlag != "docker" {
+		fmt.Fprintln(flag.CommandLine.Output(), "building for "+
+			"multiple platforms requires -builder docker")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *retriesFlag < 0 {
+		fmt.Fprintln(flag.CommandLine.Output(),
+			"-retries cannot be negative")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := checkNamespaceVisibility(
+		*createNamespaceFlag); err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := checkURLMode(*urlModeFlag); err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := checkVerifyReuse(*verifyReuseFlag); err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := checkTagsOnReuse(*tagsOnReuseFlag); err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	for i, tag := range tagFlag {
+		if !*noSanitizeTagsFlag {
+			tagFlag[i] = sanitizeTag(tag)
+		}
+		if !validTag.MatchString(tagFlag[i]) {
+			fmt.Fprintf(flag.CommandLine.Output(),
+				"'%s' is not a valid image tag\n", tag)
+			flag.Usage()
+			os.Exit(2)
+		}
+	}
+
+	if *dryRunFlag && *attestDecisionFlag != "" {
+		fmt.Fprintln(flag.CommandLine.Output(),
+			"-dry-run and -attest-decision are mutually exclusive")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *lockFlag < 0 {
+		fmt.Fprintln(flag.CommandLine.Output(),
+			"-lock cannot be negative")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *waitFlag < 0 {
+		fmt.Fprintln(flag.CommandLine.Output(),
+			"-wait-for-existing cannot be negative")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *ephemeralFlag < 0 {
+		fmt.Fprintln(flag.CommandLine.Output(),
+			"-ephemeral cannot be negative")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *ephemeralFlag != 0 && (len(tagFlag) > 0 || *immutableTagsFlag ||
+		*formatFlag == "nomad" || *lockFlag != 0 || *waitFlag != 0) {
+		fmt.Fprintln(flag.CommandLine.Output(), "-ephemeral cannot be "+
+			"used with -t, -immutable-tags, -format nomad, -lock, "+
+			"or -wait-for-existing")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *noBuildFlag && *forceRebuildFlag {
+		fmt.Fprintln(flag.CommandLine.Output(),
+			"-no-build and -force-rebuild are mutually exclusive")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if !isFingerprintMode(*modeFlag) {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"invalid fingerprint mode '%s'\n", *modeFlag)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// The environment variables keep the secrets out of the process
+	// list.
+	creds := registryCredentials{
+		user: flagOrEnv(*registryUserFlag,
+			"DOCKER_REUSE_REGISTRY_USER"),
+		password: flagOrEnv(*registryPasswordFlag,
+			"DOCKER_REUSE_REGISTRY_PASSWORD"),
+		token: flagOrEnv(*registryTokenFlag,
+			"DOCKER_REUSE_REGISTRY_TOKEN"),
+	}
+	if creds.password != "" && creds.token != "" {
+		fmt.Fprintln(flag.CommandLine.Output(), "a registry password "+
+			"and a registry token cannot be used together")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if (*ecrFlag || *garFlag || *acrFlag) &&
+		(creds.password != "" || creds.token != "") {
+		fmt.Fprintln(flag.CommandLine.Output(), "-ecr, -gar, and -acr "+
+			"cannot be used with registry credentials")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if creds.password != "" && creds.user == "" {
+		fmt.Fprintln(flag.CommandLine.Output(),
+			"a registry password requires a registry user name")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *fingerprintFlag != "" && !validTag.MatchString(*fingerprintFlag) {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"'%s' is not a valid image tag\n", *fingerprintFlag)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// The digest is only looked up if it is going to be reported.
+	resolveDigest := *auditLogFlag != "" || *attestDecisionFlag != "" ||
+		*refFileFlag != "" || *digestFlag || *verifyReuseFlag != ""
+
+	// Multi-platform images can only be pushed by buildx directly.
+	// Otherwise, buildx builds and pushes the image in a single step
+	// if it is available, unless '-buildx-push=false' is given.
+	platforms := parsePlatforms(*platformFlag)
+	buildxPush := *buildxPushFlag || len(platforms) > 1
+	if !buildxPush {
+		buildxPushSet := false
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "buildx-push" {
+				buildxPushSet = true
+			}
+		})
+		buildxPush = !buildxPushSet && buildxAvailable()
+	}
+
+	opts := options{
+		dockerfile:    *dockerfileFlag,
+		target:        *targetFlag,
+		platforms:     platforms,
+		placeholder:   *imagePlaceholderFlag,
+		format:        *formatFlag,
+		fingerprint:   *fingerprintFlag,
+		mode:          *modeFlag,
+		dumpInput:     *dumpInputFlag,
+		trackedOnly:   *trackedOnlyFlag,
+		noGitignore:   *noGitignoreFlag,
+		excludes:      excludeFlag,
+		buildContexts: buildContextFlag,
+		alsoCheck:     alsoCheckFlag,
+		mirrors:       mirrorFlag,
+		pinBase:       *pinBaseFlag,
+		urlMode:       *urlModeFlag,
+		forceRebuild:  *forceRebuildFlag,
+		injectArgs:    *injectFingerprintFlag,
+		immutableTags: *immutableTagsFlag,
+		noBuild:       *noBuildFlag,
+		buildxPush:    buildxPush,
+		buildxBuilder: *buildxBuilderFlag,
+		resolveDigest: resolveDigest,
+		ssh:           sshFlag,
+		secrets:       secretFlag,
+		ignoredSecret: map[string]bool{},
+		cacheFrom:     cacheFromFlag,
+		cacheTo:       cacheToFlag,
+		buildFlags:    buildFlags,
+		hashFlags:     *hashFlagsFlag,
+		noAutoCache:   *noAutoCacheFlag,
+		inlineCache:   *inlineCacheFlag,
+		provenance:    *provenanceFlag,
+		sbom:          *sbomFlag,
+		tags:          tagFlag,
+		tagsOnReuse:   *tagsOnReuseFlag,
+		forceTagMove:  *forceTagMoveFlag,
+		dryRun:        *dryRunFlag,
+		lintMode:      *lintFlag,
+		strictArgs:    *strictArgsFlag,
+		secretArgs:    map[string]bool{},
+		argFiles:      map[string]string{},
+		ignoredArgs:   map[string]bool{},
+		allowBinary:   *allowBinaryFlag,
+		postUpdate:    *postUpdateFlag,
+		insecureHosts: map[string]bool{},
+		visibility:    *createNamespaceFlag,
+		ecr:           *ecrFlag,
+		gar:           *garFlag,
+		acr:           *acrFlag,
+		retries:       *retriesFlag,
+		retryDelay:    *retryDelayFlag,
+		ephemeral:     *ephemeralFlag,
+		digestRefs:    *digestFlag,
+		verifyReuse:   *verifyReuseFlag,
+		stateFile:     *stateFileFlag,
+		lockTTL:       *lockFlag,
+		waitTimeout:   *waitFlag,
+		quiet:         *quietFlag,
+	}
+
+	var results []*imageResult
+	var err error
+
+	runStart := time.Now()
+
+	// Build argument values and credentials are not recorded in
+	// the audit log.
+	auditArgs := scrubSecretFlags(os.Args[1:], false)
+
+	if creds.password != "" || creds.token != "" {
+		opts.credentials = &creds
+	}
+
+	if *proxyFlag != "" {
+		if opts.proxy, err = parseProxyURL(*proxyFlag); err != nil {
+			fmt.Fprintln(flag.CommandLine.Output(), err)
+			flag.Usage()
+			os.Exit(2)
+		}
+	}
+
+	if caFile := flagOrEnv(*registryCAFlag,
+		"DOCKER_REUSE_REGISTRY_CA"); caFile != "" {
+		if opts.caCerts, err = loadCACerts(caFile); err != nil {
+			exitWithError(err)
+		}
+	}
+
+	for _, host := range insecureRegistryFlag {
+		registry, err := registryHost(host)
+		if err != nil {
+			fmt.Fprintln(flag.CommandLine.Output(), err)
+			flag.Usage()
+			os.Exit(2)
+		}
+		opts.insecureHosts[registry] = true
+	}
+	for _, name := range secretArgFlag {
+		opts.secretArgs[name] = true
+	}
+	for _, name := range ignoreArgFlag {
+		opts.ignoredArgs[name] = true
+	}
+	for _, id := range ignoreSecretFlag {
+		opts.ignoredSecret[id] = true
+	}
+
+	if *skaffoldFlag != "" {
+		var templateFilename string
+		if len(args) > 0 {
+			templateFilename = args[0]
+		}
+
+		results, err = findOrBuildSkaffoldArtifacts(*skaffoldFlag,
+			templateFilename, *skaffoldOutputFlag, &opts)
+	} else {
+		buildArgs := args[3:]
+		end := len(auditArgs)
+		if dashes {
+			end -= len(buildFlags) + 1
+		}
+		auditArgs = append(redactBuildArgs(auditArgs[:end],
+			len(buildArgs)), auditArgs[end:]...)
+
+		// Only the positional build arguments can refer to files with
+		// '@path'; the values read from the env files, which may be
+		// shared with other tools, are taken literally.
+		buildArgs, err = readBuildArgFiles(buildArgs, opts.argFiles)
+		if err != nil {
+			exitWithError(err)
+		}
+
+		// The positional build arguments override those read from
+		// the files, and the later files override the earlier ones.
+		var fileArgs [][]string
+		for _, filename := range envFileFlag {
+			envArgs, err := readEnvFile(filename)
+			if err != nil {
+				exitWithError(err)
+			}
+			fileArgs = append(fileArgs, envArgs)
+		}
+		buildArgs = mergeBuildArgs(append(fileArgs, buildArgs)...)
+
+		// The credentials are left out of the Makefile, so they are
+		// taken from the environment when make runs.
+		var makeArgs []string
+		if emitMake {
+			for _, arg := range scrubSecretFlags(os.Args[1:], true) {
+				if arg != "emit-make" {
+					makeArgs = append(makeArgs, arg)
+				}
+			}
+		}
+
+		// Load any missing build argument values from the respective
+		// environment variables.  This job cannot be left to docker
+		// because argument values are part of the image fingerprint.
+		// As with docker build, the arguments whose variables are not
+		// set are dropped, so that the Dockerfile defaults apply.
+		opts.buildArgs = nil
+		for _, arg := range buildArgs {
+			if !strings.ContainsRune(arg, '=') {
+				value, ok := os.LookupEnv(arg)
+				if !ok {
+					continue
+				}
+				arg += "=" + value
+			}
+			opts.buildArgs = append(opts.buildArgs, arg)
+		}
+
+		if emitMake {
+			// Keep the output clean for redirection.
+			opts.quiet = true
+			if err := emitMakefile(os.Stdout, args[0], args[1],
+				buildArgs, &opts, makeArgs); err != nil {
+				exitWithError(err)
+			}
+			return
+		}
+
+		var result *imageResult
+		result, err = findOrBuildAndPushImage(
+			args[0], args[1], args[2], &opts)
+		if result != nil {
+			results = append(results, result)
+		}
+	}
+
+	if err == nil && *changedFilesFlag != "" && !*dryRunFlag {
+		err = writeChangedFiles(*changedFilesFlag, results)
+	}
+
+	if err == nil && *refFileFlag != "" && !*dryRunFlag {
+		err = writeRefFile(*refFileFlag, results)
+	}
+
+	if err == nil && *attestDecisionFlag != "" {
+		err = writeDecisionAttestation(*attestDecisionFlag, results)
+	}
+
+	if *stateFileFlag != "" && !*dryRunFlag {
+		if stateErr := recordRun(
+			*stateFileFlag, results); stateErr != nil {
+			fmt.Fprintf(os.Stderr, "Warning: unable to update "+
+				"the statistics: %v\n", stateErr)
+		}
+	}
+
+	if *metricsPushFlag != "" && !*dryRunFlag {
+		// With -from-skaffold, the repositories of the artifacts
+		// are taken from the results.
+		var repository string
+		if *skaffoldFlag == "" {
+			repository = args[1]
+		}
+		if metricsErr := pushMetrics(*metricsPushFlag, repository,
+			time.Since(runStart), results, err); metricsErr != nil {
+			fmt.Fprintf(os.Stderr, "Warning: unable to push "+
+				"the metrics: %v\n", metricsErr)
+		}
+	}
+
+	if *auditLogFlag != "" {
+		auditErr := appendAuditRecord(
+			*auditLogFlag, auditArgs, results, err)
+		if auditErr != nil {
+			if err == nil {
+				exitWithError(auditErr)
+			}
+			fmt.Fprintf(os.Stderr, "Warning: unable to write "+
+				"the audit log: %v\n", auditErr)
+		}
+	}
+
+	if err != nil {
+		exitWithError(err)
 	}
 }
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var (
+	reNonIdentifier = regexp.MustCompile(`[^A-Za-z0-9]+`)
+	reShellSafe     = regexp.MustCompile(`^[-+=/.,:@%\w]+$`)
+)
+
+// makeShellWord quotes the argument for the shell, if necessary, and
+// escapes the dollar signs for make.
+func makeShellWord(arg string) string {
+	if !reShellSafe.MatchString(arg) {
+		arg = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+	return strings.ReplaceAll(arg, "$", "$$")
+}
+
+func makeCommand(arg ...string) string {
+	words := make([]string, len(arg))
+	for i, a := range arg {
+		words[i] = makeShellWord(a)
+	}
+	return strings.Join(words, " ")
+}
+
+// secretArgName strips the value of a secret build argument, which
+// makes docker and docker-reuse take it from the environment.
+func secretArgName(buildArg string, opts *options) string {
+	name := strings.SplitN(buildArg, "=", 2)[0]
+	if opts.secretArgs[name] {
+		return name
+	}
+	return buildArg
+}
+
+// emitMakefile writes a Makefile snippet that defines a variable holding
+// the image reference with the computed fingerprint, and phony targets
+// that build and push the image and update the template file by running
+// docker-reuse with the given arguments. The variable and the targets are
+// named after the last component of the image name. The build arguments
+// are passed to the build command as given on the command line, so those
+// without a value are taken from the environment when make runs. So are
+// the values of the secret build arguments and the registry credentials,
+// which are never written out.
+func emitMakefile(w io.Writer, workingDir, imageName string,
+	buildArgs []string, opts *options, reuseArgs []string) error {
+
+	fingerprint := opts.fingerprint
+	if fingerprint == "" {
+		var err error
+		if fingerprint, err = computeFingerprint(
+			workingDir, opts, nil); err != nil {
+			return err
+		}
+	}
+
+	name := strings.Trim(reNonIdentifier.ReplaceAllString(
+		path.Base(imageName), "_"), "_")
+	variable := strings.ToUpper(name) + "_IMAGE"
+	target := strings.ToLower(strings.ReplaceAll(name, "_", "-"))
+
+	build := []string{buildTool, "build", workingDir,
+		"-t", imageName + ":" + fingerprint}
+	if opts.dockerfile != "" {
+		build = append(build, "-f", opts.dockerfile)
+	}
+	if opts.target != "" {
+		build = append(build, "--target", opts.target)
+	}
+	if len(opts.platforms) != 0 {
+		build = append(build, "--platform",
+			strings.Join(opts.platforms, ","))
+	}
+	// The values read from files are not written out either: the
+	// files are read by the shell when make runs. Note that command
+	// substitution drops the trailing newlines.
+	var fileVars []string
+	for _, buildArg := range buildArgs {
+		name := strings.SplitN(buildArg, "=", 2)[0]
+		if filename := opts.argFiles[name]; filename != "" {
+			fileVars = append(fileVars, name+`="$$(cat `+
+				makeShellWord(filename)+`)"`)
+			buildArg = name
+		}
+		build = append(build,
+			"--build-arg", secretArgName(buildArg, opts))
+	}
+	for _, context := range opts.buildContexts {
+		build = append(build, "--build-context", context)
+	}
+	for _, spec := range opts.ssh {
+		build = append(build, "--ssh", spec)
+	}
+	for _, spec := range opts.secrets {
+		build = append(build, "--secret", spec)
+	}
+	for _, cache := range opts.cacheFrom {
+		build = append(build, "--cache-from", cache)
+	}
+	for _, cache := range opts.cacheTo {
+		build = append(build, "--cache-to", cache)
+	}
+	if opts.inlineCache && buildTool == "docker" {
+		build = append(build, "--build-arg", "BUILDKIT_INLINE_CACHE=1")
+	}
+	build = append(build, opts.buildFlags...)
+	build = append(build, "--label", fingerprintLabel+"="+fingerprint)
+
+	// The image reference in the build command is replaced with
+	// the variable so that it can be overridden.
+	buildCommand := strings.Replace(makeCommand(build...),
+		makeShellWord(imageName+":"+fingerprint), "$("+variable+")", 1)
+	buildCommand = strings.Join(append(fileVars, buildCommand), " ")
+
+	for i, arg := range reuseArgs {
+		reuseArgs[i] = secretArgName(arg, opts)
+	}
+
+	_, err := fmt.Fprintf(w, `# Generated by docker-reuse. Do not edit.
+%[1]s := %[2]s
+
+.PHONY: %[3]s-build %[3]s-push %[3]s-update
+
+%[3]s-build:
+	%[4]s
+
+%[3]s-push: %[3]s-build
+	%[6]s push $(%[1]s)
+
+%[3]s-update:
+	%[5]s
+`, variable, imageName+":"+fingerprint, target, buildCommand,
+		makeCommand(append([]string{"docker-reuse"}, reuseArgs...)...),
+		buildTool)
+	return err
+}
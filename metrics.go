@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// metricsJob is the job name under which the metrics are grouped in the
+// Pushgateway, unless the URL names the job.
+const metricsJob = "docker-reuse"
+
+// metricsClient sends the metrics. A Pushgateway that does not respond
+// must not hold up the pipeline.
+var metricsClient = &http.Client{Timeout: 10 * time.Second}
+
+// metricsURL returns the Pushgateway URL for the metrics of the run. Each
+// push replaces the metrics of its group, so besides the job, the metrics
+// are grouped by the host (the 'instance' label) and the image repository
+// (the 'repository' label), unless the URL already sets these labels.
+// The label values are base64-encoded because they may contain slashes.
+func metricsURL(url, instance, repository string) string {
+	if !strings.Contains(url, "/metrics/job/") {
+		url = strings.TrimSuffix(url, "/") + "/metrics/job/" +
+			metricsJob
+	}
+	for _, label := range []struct{ name, value string }{
+		{"instance", instance}, {"repository", repository}} {
+
+		if strings.Contains(url, "/"+label.name+"/") ||
+			strings.Contains(url, "/"+label.name+"@base64/") {
+			continue
+		}
+		value := base64.URLEncoding.EncodeToString([]byte(label.value))
+		if value == "" {
+			// The Pushgateway way to encode an empty value.
+			value = "="
+		}
+		url += "/" + label.name + "@base64/" + value
+	}
+	return url
+}
+
+// metricsRepository returns the value of the 'repository' grouping label:
+// the image repository, or the sorted list of the repositories of the
+// resulting images if more than one image is built.
+func metricsRepository(repository string, results []*imageResult) string {
+	if repository != "" {
+		return repository
+	}
+	var repositories []string
+	seen := map[string]bool{}
+	for _, result := range results {
+		name := repositoryName(result.Image)
+		if !seen[name] {
+			repositories = append(repositories, name)
+			seen[name] = true
+		}
+	}
+	sort.Strings(repositories)
+	return strings.Join(repositories, ",")
+}
+
+// escapeLabelValue escapes a label value for the Prometheus text format.
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).
+		Replace(value)
+}
+
+// formatMetrics renders the metrics of the run in the Prometheus text
+// exposition format. The per-image metrics are labeled with the image
+// repository and the reuse decision.
+func formatMetrics(duration time.Duration, results []*imageResult,
+	runErr error) []byte {
+
+	var b bytes.Buffer
+
+	gauge := func(name, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n",
+			name, help, name)
+	}
+
+	success := 1
+	if runErr != nil {
+		success = 0
+	}
+
+	gauge("docker_reuse_run_duration_seconds",
+		"Duration of the docker-reuse run.")
+	fmt.Fprintf(&b, "docker_reuse_run_duration_seconds %g\n",
+		duration.Seconds())
+	gauge("docker_reuse_run_success",
+		"Whether the docker-reuse run succeeded.")
+	fmt.Fprintf(&b, "docker_reuse_run_success %d\n", success)
+
+	imageMetrics := []struct {
+		name, help string
+		value      func(result *imageResult) float64
+	}{
+		{"docker_reuse_image_reused",
+			"Whether the image was reused rather than built.",
+			func(result *imageResult) float64 {
+				if result.Decision == "reused" {
+					return 1
+				}
+				return 0
+			}},
+		{"docker_reuse_fingerprint_duration_seconds",
+			"Time spent computing the fingerprint.",
+			func(result *imageResult) float64 {
+				return result.FingerprintSeconds
+			}},
+		{"docker_reuse_hashed_bytes",
+			"Amount of data hashed to compute the fingerprint.",
+			func(result *imageResult) float64 {
+				return float64(result.BytesHashed)
+			}},
+		{"docker_reuse_build_duration_seconds",
+			"Time spent building and pushing the image.",
+			func(result *imageResult) float64 {
+				return result.BuildSeconds
+			}},
+		{"docker_reuse_saved_seconds",
+			"Recorded build time of the reused image.",
+			func(result *imageResult) float64 {
+				return result.SavedSeconds
+			}},
+	}
+
+	for _, metric := range imageMetrics {
+		if len(results) == 0 {
+			break
+		}
+		gauge(metric.name, metric.help)
+		for _, result := range results {
+			fmt.Fprintf(&b, "%s{image=\"%s\",decision=\"%s\"} %g\n",
+				metric.name,
+				escapeLabelValue(repositoryName(result.Image)),
+				escapeLabelValue(result.Decision),
+				metric.value(result))
+		}
+	}
+
+	return b.Bytes()
+}
+
+// pushMetrics sends the metrics of the run to the Prometheus Pushgateway,
+// replacing the metrics previously pushed for the same image repository
+// from the same host. The repository is that of the results if empty.
+func pushMetrics(url, repository string, duration time.Duration,
+	results []*imageResult, runErr error) error {
+
+	instance, _ := os.Hostname()
+	req, err := http.NewRequest(http.MethodPut, metricsURL(url, instance,
+		metricsRepository(repository, results)),
+		bytes.NewReader(formatMetrics(duration, results, runErr)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	resp, err := metricsClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("'%s': %s", url, resp.Status)
+	}
+
+	return nil
+}
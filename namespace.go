@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// checkNamespaceVisibility validates the value of the '-create-namespace'
+// option.
+func checkNamespaceVisibility(visibility string) error {
+	switch visibility {
+	case "", "public", "private":
+		return nil
+	}
+	return errors.New("-create-namespace must be " +
+		"either 'public' or 'private'")
+}
+
+// namespaceClient sends the requests to the management API of a Harbor
+// or Quay registry.
+type namespaceClient struct {
+	baseURL string
+	client  *http.Client
+	creds   *registryCredentials
+}
+
+// do sends the request with the explicitly given credentials and returns
+// the response status code. Harbor robot accounts authenticate with a user
+// name and a password; Quay requires an OAuth access token.
+func (c *namespaceClient) do(method, path string,
+	body interface{}) (int, error) {
+
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return 0, err
+		}
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+path,
+		bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.creds.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.creds.token)
+	} else {
+		req.SetBasicAuth(c.creds.user, c.creds.password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode, nil
+}
+
+// found tells whether the resource exists, treating any status other
+// than 200 or 404 as an error.
+func (c *namespaceClient) found(method, path string) (bool, error) {
+	status, err := c.do(method, path, nil)
+	if err != nil {
+		return false, err
+	}
+	switch status {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("'%s%s': %s", c.baseURL, path,
+		http.StatusText(status))
+}
+
+// probe tells whether the endpoint exists.
+func (c *namespaceClient) probe(path string) bool {
+	status, err := c.do(http.MethodGet, path, nil)
+	return err == nil && status == http.StatusOK
+}
+
+// create sends the request that creates the resource. A conflict means
+// that the resource has been created concurrently, which is fine.
+func (c *namespaceClient) create(path string, body interface{}) error {
+	status, err := c.do(http.MethodPost, path, body)
+	if err != nil {
+		return err
+	}
+	if status/100 != 2 && status != http.StatusConflict {
+		return fmt.Errorf("'%s%s': %s", c.baseURL, path,
+			http.StatusText(status))
+	}
+	return nil
+}
+
+// ensureHarborProject creates the Harbor project that the repository
+// belongs to, unless it already exists.
+func ensureHarborProject(c *namespaceClient, repository string,
+	opts *options) (bool, error) {
+
+	project := strings.SplitN(repository, "/", 2)[0]
+
+	exists, err := c.found(http.MethodHead,
+		"/api/v2.0/projects?project_name="+url.QueryEscape(project))
+	if err != nil || exists {
+		return false, err
+	}
+
+	return true, c.create("/api/v2.0/projects", map[string]interface{}{
+		"project_name": project,
+		"metadata": map[string]string{
+			"public": fmt.Sprint(opts.visibility == "public"),
+		},
+	})
+}
+
+// ensureQuayRepository creates the Quay repository, unless it already
+// exists. Quay repositories belong to an organization or a user, which
+// must exist.
+func ensureQuayRepository(c *namespaceClient, repository string,
+	opts *options) (bool, error) {
+
+	parts := strings.SplitN(repository, "/", 2)
+	if len(parts) != 2 {
+		return false, fmt.Errorf("'%s' does not include "+
+			"the Quay namespace", repository)
+	}
+
+	exists, err := c.found(http.MethodGet,
+		"/api/v1/repository/"+repository)
+	if err != nil || exists {
+		return false, err
+	}
+
+	return true, c.create("/api/v1/repository", map[string]string{
+		"namespace":   parts[0],
+		"repository":  parts[1],
+		"visibility":  opts.visibility,
+		"description": "",
+		"repo_kind":   "image",
+	})
+}
+
+// ensureNamespace creates the Harbor project or the Quay repository of
+// the image before it is pushed for the first time, with the visibility
+// given by '-create-namespace'. The kind of the registry is detected by
+// probing the endpoints that are specific to each of them.
+func ensureNamespace(imageName string, opts *options) error {
+	ref, err := parseReference(imageName, opts)
+	if err != nil {
+		return err
+	}
+	registry := ref.Context().Registry
+
+	if opts.credentials == nil ||
+		opts.credentials.registry != registry.RegistryStr() {
+		return errors.New("-create-namespace requires " +
+			"the registry credentials")
+	}
+
+	c := &namespaceClient{
+		baseURL: registry.Scheme() + "://" + registry.RegistryStr(),
+		client:  &http.Client{Transport: registryTransport(opts)},
+		creds:   opts.credentials,
+	}
+	repository := ref.Context().RepositoryStr()
+
+	var created bool
+	switch {
+	case c.probe("/api/v2.0/systeminfo"):
+		created, err = ensureHarborProject(c, repository, opts)
+	case c.probe("/api/v1/discovery"):
+		created, err = ensureQuayRepository(c, repository, opts)
+	default:
+		return fmt.Errorf("-create-namespace: %s is neither "+
+			"a Harbor nor a Quay registry", registry.RegistryStr())
+	}
+	if err != nil {
+		return fmt.Errorf("unable to create the namespace of '%s': %v",
+			imageName, err)
+	}
+
+	if created && !opts.quiet {
+		fmt.Println("Created the namespace of", repositoryName(imageName))
+	}
+	return nil
+}
+
+// prepareRepository makes sure that the repository of the image exists
+// before the image is pushed to it, creating it if requested.
+func prepareRepository(imageName string, opts *options) error {
+	if opts.ecr {
+		if repo := parseECRRepository(imageName, opts); repo != nil {
+			return ensureECRRepository(repo, opts)
+		}
+	}
+	if opts.visibility != "" {
+		return ensureNamespace(imageName, opts)
+	}
+	return nil
+}
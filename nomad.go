@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// checkFormat validates the value of the '-format' option.
+func checkFormat(format string) error {
+	switch format {
+	case "text", "nomad":
+		return nil
+	}
+	return errors.New("-format must be either 'text' or 'nomad'")
+}
+
+// stringLiteral returns the value of an attribute that is a plain quoted
+// string without interpolations.
+func stringLiteral(attr *hclwrite.Attribute) (string, bool) {
+	tokens := attr.Expr().BuildTokens(nil)
+	if len(tokens) != 3 || tokens[0].Type != hclsyntax.TokenOQuote ||
+		tokens[1].Type != hclsyntax.TokenQuotedLit ||
+		tokens[2].Type != hclsyntax.TokenCQuote {
+		return "", false
+	}
+	return string(tokens[1].Bytes), true
+}
+
+// utf8BOM is the byte order mark that some Windows editors insert at the
+// beginning of text files.
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// updateNomadJob sets the 'image' attribute of the task driver configs
+// in the Nomad job specification that refer to the image (with any tag
+// or digest) or, if specified, are equal to the placeholder. The rest of
+// the file, including comments, formatting, line endings, and the byte
+// order mark, is preserved.
+func updateNomadJob(contents []byte, filename, imageName, placeholder,
+	newImageRef string) ([]byte, error) {
+
+	// The HCL writer would drop the byte order mark.
+	hasBOM := bytes.HasPrefix(contents, utf8BOM)
+	if hasBOM {
+		contents = contents[len(utf8BOM):]
+	}
+
+	f, diags := hclwrite.ParseConfig(contents, filename, hcl.InitialPos)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	matches := func(value string) bool {
+		if placeholder != "" {
+			return value == placeholder
+		}
+		return value == imageName ||
+			strings.HasPrefix(value, imageName+":") ||
+			strings.HasPrefix(value, imageName+"@")
+	}
+
+	updated := 0
+
+	var walk func(body *hclwrite.Body, inTask bool)
+	walk = func(body *hclwrite.Body, inTask bool) {
+		for _, block := range body.Blocks() {
+			if inTask && block.Type() == "config" {
+				config := block.Body()
+				attr := config.GetAttribute("image")
+				if attr == nil {
+					continue
+				}
+				if value, ok := stringLiteral(attr); ok &&
+					matches(value) {
+					config.SetAttributeValue("image",
+						cty.StringVal(newImageRef))
+					updated++
+				}
+				continue
+			}
+			walk(block.Body(), block.Type() == "task")
+		}
+	}
+	walk(f.Body(), false)
+
+	if updated == 0 {
+		ref := imageName
+		if placeholder != "" {
+			ref = placeholder
+		}
+		return nil, fmt.Errorf("'%s' does not contain task configs "+
+			"with image '%s'", filename, ref)
+	}
+
+	if hasBOM {
+		return append(append([]byte(nil), utf8BOM...),
+			f.Bytes()...), nil
+	}
+	return f.Bytes(), nil
+}
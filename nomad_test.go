@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// nomadJob returns a Nomad job specification that runs the image, with
+// the lines terminated by the respective line endings (the last one is
+// reused for the remaining lines).
+func nomadJob(image string, eols ...string) string {
+	lines := []string{
+		`# Deployed by CI`,
+		`job "app" {`,
+		`  group "web" {`,
+		`    task "server" {`,
+		`      driver = "docker"`,
+		`      config {`,
+		`        image = "` + image + `"`,
+		`      }`,
+		`    }`,
+		`  }`,
+		`}`,
+	}
+
+	var b strings.Builder
+	for i, line := range lines {
+		b.WriteString(line)
+		if i < len(eols) {
+			b.WriteString(eols[i])
+		} else {
+			b.WriteString(eols[len(eols)-1])
+		}
+	}
+	return b.String()
+}
+
+func TestUpdateNomadJobPreservesLineEndings(t *testing.T) {
+	const oldImage = "registry.example.com/app:0123abcd"
+	const newImage = "registry.example.com/app:4567cdef"
+
+	tests := []struct {
+		name string
+		bom  string
+		eols []string
+	}{
+		{"LF", "", []string{"\n"}},
+		{"CRLF", "", []string{"\r\n"}},
+		{"BOM and CRLF", string(utf8BOM), []string{"\r\n"}},
+		{"BOM and LF", string(utf8BOM), []string{"\n"}},
+		{"mixed LF and CRLF", "",
+			[]string{"\n", "\r\n", "\n", "\r\n", "\r\n", "\n",
+				"\r\n", "\n", "\n", "\r\n", "\n"}},
+		{"BOM and mixed LF and CRLF", string(utf8BOM),
+			[]string{"\r\n", "\n", "\r\n", "\n", "\n", "\r\n",
+				"\n", "\r\n", "\r\n", "\n", "\r\n"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			input := test.bom + nomadJob(oldImage, test.eols...)
+			want := test.bom + nomadJob(newImage, test.eols...)
+
+			output, err := updateNomadJob([]byte(input), "job.nomad",
+				"registry.example.com/app", "", newImage)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(output) != want {
+				t.Errorf("got %q, want %q", output, want)
+			}
+
+			// Updating the result again restores the original.
+			output, err = updateNomadJob(output, "job.nomad",
+				"registry.example.com/app", "", oldImage)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(output) != input {
+				t.Errorf("round trip: got %q, want %q",
+					output, input)
+			}
+		})
+	}
+}
+
+func TestUpdateNomadJobWithoutMatchingImage(t *testing.T) {
+	input := nomadJob("registry.example.com/other:latest", "\r\n")
+
+	_, err := updateNomadJob([]byte(input), "job.nomad",
+		"registry.example.com/app", "", "registry.example.com/app:1")
+	if err == nil {
+		t.Error("expected an error for a job without the image")
+	}
+}
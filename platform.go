@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// imagePlatforms returns the platforms of the image stored in the
+// registry: those of the manifest list, or the one of the single image.
+func imagePlatforms(imageName string, opts *options) ([]v1.Platform,
+	error) {
+
+	ref, err := parseReference(imageName, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var platforms []v1.Platform
+	err = withRetries(opts, "inspecting "+imageName, func() error {
+		platforms = nil
+
+		desc, err := remote.Get(ref, registryOptions(opts)...)
+		if err != nil {
+			return err
+		}
+
+		if !desc.MediaType.IsIndex() {
+			image, err := desc.Image()
+			if err != nil {
+				return err
+			}
+			config, err := image.ConfigFile()
+			if err != nil {
+				return err
+			}
+			platforms = append(platforms, v1.Platform{
+				OS:           config.OS,
+				Architecture: config.Architecture,
+			})
+			return nil
+		}
+
+		index, err := desc.ImageIndex()
+		if err != nil {
+			return err
+		}
+		manifest, err := index.IndexManifest()
+		if err != nil {
+			return err
+		}
+		for _, m := range manifest.Manifests {
+			if m.Platform != nil {
+				platforms = append(platforms, *m.Platform)
+			}
+		}
+		return nil
+	})
+	return platforms, err
+}
+
+// platformMatches tells whether the platform given as 'os/arch[/variant]'
+// is the platform of an image. The variant is only compared if both have
+// it: the configuration of a single-platform image does not record it.
+func platformMatches(requested string, platform v1.Platform) bool {
+	parts := strings.SplitN(requested, "/", 3)
+	if len(parts) < 2 || parts[0] != platform.OS ||
+		parts[1] != platform.Architecture {
+		return false
+	}
+	return len(parts) < 3 || platform.Variant == "" ||
+		parts[2] == platform.Variant
+}
+
+// checkImagePlatforms tells whether the existing image covers all the
+// platforms given with '-platform'. An image that lacks some of them,
+// such as a single-platform image pushed under the fingerprint tag by
+// hand, is rebuilt.
+func checkImagePlatforms(imageName string, opts *options) (bool, error) {
+	platforms, err := imagePlatforms(imageName, opts)
+	if err != nil {
+		return false, fmt.Errorf("unable to get the platforms "+
+			"of '%s': %v", imageName, err)
+	}
+
+	var missing []string
+	for _, requested := range opts.platforms {
+		found := false
+		for _, platform := range platforms {
+			if platformMatches(requested, platform) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, requested)
+		}
+	}
+
+	if len(missing) == 0 {
+		return true, nil
+	}
+	fmt.Fprintf(os.Stderr, "Warning: '%s' lacks the platforms %s; "+
+		"rebuilding\n", imageName, strings.Join(missing, ", "))
+	return false, nil
+}
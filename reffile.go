@@ -0,0 +1,26 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// writeRefFile writes the fully qualified digest references of the
+// resulting images to a file, one per line, in the form accepted by
+// 'kubectl set image' and 'cosign verify'.
+func writeRefFile(filename string, results []*imageResult) error {
+	var refs []string
+
+	for _, result := range results {
+		ref, err := name.ParseReference(result.Image)
+		if err != nil {
+			return err
+		}
+		refs = append(refs, ref.Context().Name()+"@"+result.Digest)
+	}
+
+	return ioutil.WriteFile(filename,
+		[]byte(strings.Join(refs, "\n")+"\n"), 0644)
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// registryCredentials holds the registry credentials given with the
+// '-registry-*' options or the respective environment variables, or
+// obtained from the cloud provider. The credentials are only sent to the
+// registry they are for.
+type registryCredentials struct {
+	registry string
+	user     string
+	password string
+	token    string
+}
+
+// loginUser returns the user name for 'docker login'. A token without
+// a user name is sent with the name that Google registries expect;
+// most other registries accept any name with a token.
+func (c *registryCredentials) loginUser() string {
+	if c.user == "" {
+		return "oauth2accesstoken"
+	}
+	return c.user
+}
+
+// loginSecret returns the password or the token.
+func (c *registryCredentials) loginSecret() string {
+	if c.token != "" {
+		return c.token
+	}
+	return c.password
+}
+
+// authConfig returns the credentials for the registry API requests.
+// A token without a user name is a bearer token.
+func (c *registryCredentials) authConfig() authn.AuthConfig {
+	if c.user == "" {
+		return authn.AuthConfig{RegistryToken: c.token}
+	}
+	return authn.AuthConfig{Username: c.user, Password: c.loginSecret()}
+}
+
+// dockerKeychain looks up the credentials the same way as the docker CLI:
+// in the configuration file that $DOCKER_CONFIG points to (by default,
+// ~/.docker/config.json), using the credential helper named for the
+// registry in 'credHelpers' or the default one named by 'credsStore'.
+// If the helper fails, for example, because it is not installed on this
+// machine, a warning is printed and the request is made anonymously,
+// which is still enough for public repositories.
+type dockerKeychain struct{}
+
+func (dockerKeychain) Resolve(target authn.Resource) (authn.Authenticator,
+	error) {
+
+	auth, err := authn.DefaultKeychain.Resolve(target)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: unable to get the credentials "+
+			"for %s: %v\n", target.RegistryStr(), err)
+		return authn.Anonymous, nil
+	}
+	return auth, nil
+}
+
+// credentialsKeychain sends the explicitly given or obtained credentials
+// only to the registry they are for. The credentials for the other
+// registries, such as those given with '-also-check' and '-mirror' and
+// those of the base images, are looked up by dockerKeychain.
+type credentialsKeychain struct {
+	creds *registryCredentials
+}
+
+func (k credentialsKeychain) Resolve(
+	target authn.Resource) (authn.Authenticator, error) {
+
+	if k.creds != nil && target.RegistryStr() == k.creds.registry {
+		return authn.FromConfig(k.creds.authConfig()), nil
+	}
+	return dockerKeychain{}.Resolve(target)
+}
+
+// imageRegistry returns the host name of the registry of the image, or
+// an empty string if the image name is invalid.
+func imageRegistry(imageName string, opts *options) string {
+	ref, err := parseReference(imageName, opts)
+	if err != nil {
+		return ""
+	}
+	return ref.Context().RegistryStr()
+}
+
+// registryHost validates the value of the '-insecure-registry' option
+// and returns the registry host name the way it appears in the image
+// references ('docker.io' becomes 'index.docker.io').
+func registryHost(value string) (string, error) {
+	registry, err := name.NewRegistry(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid registry '%s': %v", value, err)
+	}
+	return registry.RegistryStr(), nil
+}
+
+// parseReference parses the image reference. If the registry is listed
+// with '-insecure-registry', it is allowed to be accessed over plain HTTP.
+func parseReference(imageName string, opts *options) (name.Reference,
+	error) {
+
+	ref, err := name.ParseReference(imageName)
+	if err != nil || !opts.insecureHosts[ref.Context().RegistryStr()] {
+		return ref, err
+	}
+	return name.ParseReference(imageName, name.Insecure)
+}
+
+// loadCACerts returns the system certificate pool extended with the
+// certificates from the PEM file given with '-registry-ca'.
+func loadCACerts(filename string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("'%s' does not contain "+
+			"PEM-encoded certificates", filename)
+	}
+	return pool, nil
+}
+
+// registryTransport returns the HTTP transport for the requests made
+// to the registry. Unless '-proxy' is given, the proxy is taken from
+// the HTTP_PROXY, HTTPS_PROXY, and NO_PROXY environment variables.
+func registryTransport(opts *options) http.RoundTripper {
+	if len(opts.insecureHosts) == 0 && opts.caCerts == nil &&
+		opts.proxy == nil {
+		return http.DefaultTransport
+	}
+	httpTransport := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.caCerts != nil {
+		httpTransport.TLSClientConfig = &tls.Config{
+			RootCAs: opts.caCerts}
+	}
+	if opts.proxy != nil {
+		// The proxy credentials, if any, are taken from the URL.
+		httpTransport.Proxy = http.ProxyURL(opts.proxy)
+	}
+	if len(opts.insecureHosts) == 0 {
+		return httpTransport
+	}
+
+	// Registries that do use TLS in such setups usually have
+	// self-signed certificates.
+	insecureTransport := httpTransport.Clone()
+	insecureTransport.TLSClientConfig = &tls.Config{
+		InsecureSkipVerify: true}
+	return &hostTransport{hosts: opts.insecureHosts,
+		insecure: insecureTransport, secure: httpTransport}
+}
+
+// hostTransport skips the verification of the TLS certificates only for
+// the registries listed with '-insecure-registry', like the
+// 'insecure-registries' setting of the Docker daemon. The requests to the
+// other hosts, such as the token servers, are verified as usual.
+type hostTransport struct {
+	hosts    map[string]bool
+	insecure http.RoundTripper
+	secure   http.RoundTripper
+}
+
+func (t *hostTransport) RoundTrip(req *http.Request) (*http.Response,
+	error) {
+
+	if t.hosts[req.URL.Host] {
+		return t.insecure.RoundTrip(req)
+	}
+	return t.secure.RoundTrip(req)
+}
+
+// parseProxyURL validates the value of the '-proxy' option.
+func parseProxyURL(value string) (*url.URL, error) {
+	proxy, err := url.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+	switch proxy.Scheme {
+	case "http", "https", "socks5":
+		if proxy.Host != "" {
+			return proxy, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid proxy URL '%s'", value)
+}
+
+// registryOptions returns the options for the registry API requests.
+// Unless the credentials for the registry are given explicitly, they are
+// taken from the docker configuration.
+func registryOptions(opts *options) []remote.Option {
+	return []remote.Option{
+		remote.WithTransport(registryTransport(opts)),
+		remote.WithAuthFromKeychain(
+			credentialsKeychain{opts.credentials}),
+	}
+}
+
+// dockerLogin logs the docker CLI in to the registry that the explicitly
+// given credentials are for, so that the build, push, and tagging commands
+// can access the registry. The secret is passed through the standard
+// input.
+func dockerLogin(imageName string, opts *options) error {
+	args := []string{"login", "-u", opts.credentials.loginUser(),
+		"--password-stdin"}
+	// Docker Hub is the default of 'docker login'.
+	if registry := opts.credentials.registry; registry !=
+		name.DefaultRegistry {
+		args = append(args, registry)
+	}
+
+	err := withRetries(opts, "logging in", func() error {
+		cmd := exec.Command(buildTool, args...)
+		cmd.Stdin = strings.NewReader(opts.credentials.loginSecret())
+		cmd.Stderr = os.Stderr
+		if !opts.quiet {
+			cmd.Stdout = os.Stdout
+		}
+		return cmd.Run()
+	})
+	if err != nil {
+		return fmt.Errorf("unable to log in to the registry of '%s': "+
+			"%v", imageName, err)
+	}
+	return nil
+}
+
+// isNotFound tells whether the registry responded that the manifest or
+// the repository does not exist.
+func isNotFound(err error) bool {
+	var transportErr *transport.Error
+	if !errors.As(err, &transportErr) {
+		return false
+	}
+	if transportErr.StatusCode == http.StatusNotFound {
+		return true
+	}
+	for _, diagnostic := range transportErr.Errors {
+		switch diagnostic.Code {
+		case transport.ManifestUnknownErrorCode,
+			transport.NameUnknownErrorCode:
+			return true
+		}
+	}
+	return false
+}
+
+// imageExists checks if the image already exists in the registry by
+// requesting its manifest directly from the registry API, which requires
+// neither the docker daemon nor the experimental CLI features.
+func imageExists(imageName string, opts *options) (bool, error) {
+	ref, err := parseReference(imageName, opts)
+	if err != nil {
+		return false, err
+	}
+
+	exists := true
+	err = withRetries(opts, "checking "+imageName, func() error {
+		_, err := remote.Head(ref, registryOptions(opts)...)
+		if isNotFound(err) {
+			exists = false
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return false, fmt.Errorf("unable to check if '%s' exists: %v",
+			imageName, err)
+	}
+
+	return exists, nil
+}
+
+// mirrorImageName returns the name that the image would have in the
+// registry or namespace given with '-also-check': the last component of
+// the repository name and the tag are appended to it.
+func mirrorImageName(mirror, imageName string) string {
+	return strings.TrimSuffix(mirror, "/") + "/" + path.Base(imageName)
+}
+
+// findInMirrors checks the registries given with '-also-check' in order
+// and returns the name of the first image found, or an empty string.
+// A registry that cannot be checked is skipped with a warning, so that
+// an unavailable mirror does not fail the run.
+func findInMirrors(imageName string, opts *options) string {
+	for _, mirror := range opts.alsoCheck {
+		mirrorName := mirrorImageName(mirror, imageName)
+		exists, err := imageExists(mirrorName, opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+			continue
+		}
+		if exists {
+			return mirrorName
+		}
+	}
+	return ""
+}
+
+// copyImage copies the image, along with all of its platforms if it is
+// a multi-platform image, from one registry to another through the
+// registry API. Only the blobs that the target repository does not
+// have yet are transferred, and the manifests are copied unchanged, so
+// the digest stays the same.
+func copyImage(srcName, dstName string, opts *options) error {
+	src, err := parseReference(srcName, opts)
+	if err != nil {
+		return err
+	}
+	dst, err := parseReference(dstName, opts)
+	if err != nil {
+		return err
+	}
+
+	err = withRetries(opts, "copying "+srcName, func() error {
+		desc, err := remote.Get(src, registryOptions(opts)...)
+		if err != nil {
+			return err
+		}
+
+		switch desc.MediaType {
+		case types.OCIImageIndex, types.DockerManifestList:
+			index, err := desc.ImageIndex()
+			if err != nil {
+				return err
+			}
+			return remote.WriteIndex(dst, index,
+				registryOptions(opts)...)
+		}
+
+		image, err := desc.Image()
+		if err != nil {
+			return err
+		}
+		return remote.Write(dst, image, registryOptions(opts)...)
+	})
+	if err != nil {
+		return fmt.Errorf("unable to copy '%s' to '%s': %v",
+			srcName, dstName, err)
+	}
+	return nil
+}
+
+// pushToMirrors copies the image to the registries given with '-mirror',
+// unless it is already there, and creates the additional tags applied in
+// the target repository there as well. Since the layers are copied once,
+// the tags amount to uploading the manifest.
+func pushToMirrors(imageName string, taggedNames []string,
+	opts *options) error {
+
+	for _, mirror := range opts.mirrors {
+		mirrorName := mirrorImageName(mirror, imageName)
+		exists, err := imageExists(mirrorName, opts)
+		if err != nil {
+			return err
+		}
+
+		names := taggedNames
+		if !exists {
+			names = append([]string{imageName}, names...)
+		}
+
+		for _, name := range names {
+			mirrorName = mirrorImageName(mirror, name)
+			if err = copyImage(imageName, mirrorName,
+				opts); err != nil {
+				return err
+			}
+			if !opts.quiet {
+				fmt.Println("Mirrored:", mirrorName)
+			}
+		}
+	}
+	return nil
+}
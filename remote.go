@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// remoteFileTimeout limits the time a request for a remote file may take,
+// including the download, so that a stalled server does not hang the run.
+const remoteFileTimeout = 2 * time.Minute
+
+// reChecksum matches the digests accepted by 'ADD --checksum'.
+var reChecksum = regexp.MustCompile(
+	`^(?:sha256:[0-9a-f]{64}|sha384:[0-9a-f]{96}|sha512:[0-9a-f]{128})$`)
+
+// checkURLMode validates the value of the '-url-mode' option.
+func checkURLMode(mode string) error {
+	switch mode {
+	case "etag", "last-modified", "content":
+		return nil
+	}
+	return errors.New("-url-mode must be one of " +
+		"'etag', 'last-modified', or 'content'")
+}
+
+// statusError reports an unexpected HTTP response status.
+type statusError struct {
+	url        string
+	status     string
+	statusCode int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("'%s': %s", e.url, e.status)
+}
+
+// fetchURL sends a request for the URL and checks the response status.
+// The request goes through the same proxy as the registry requests.
+func fetchURL(method, url string, opts *options) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Transport: registryTransport(opts),
+		Timeout: remoteFileTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &statusError{url, resp.Status, resp.StatusCode}
+	}
+
+	return resp, nil
+}
+
+// hashRemoteFile identifies the file that ADD downloads from a URL.
+// The checksum declared with 'ADD --checksum' is used if present, so
+// that no request is made.
+// Otherwise, depending on the mode, the ETag or the Last-Modified
+// response header is used, falling back to hashing the downloaded
+// contents if the server does not provide the header. The returned
+// hash type describes where the hash comes from. Failed requests are
+// retried the same as the registry requests.
+func hashRemoteFile(file remoteFile, opts *options) (string, string,
+	error) {
+
+	mode := opts.urlMode
+	if file.checksum != "" {
+		if !reChecksum.MatchString(file.checksum) {
+			return "", "", fmt.Errorf("invalid checksum '%s' "+
+				"for '%s': expected sha256, sha384, or sha512 "+
+				"followed by a colon and the hex digest",
+				file.checksum, file.url)
+		}
+		return "checksum", file.checksum, nil
+	}
+
+	// Some servers do not support HEAD requests, in which case
+	// the contents are downloaded.
+	if mode != "content" {
+		var resp *http.Response
+		head := func() (err error) {
+			resp, err = fetchURL(http.MethodHead, file.url, opts)
+			return
+		}
+		if withRetries(opts, "requesting "+file.url, head) == nil {
+			resp.Body.Close()
+
+			if etag := resp.Header.Get("ETag"); etag != "" &&
+				mode == "etag" {
+				return "etag", etag, nil
+			}
+			if lastModified := resp.Header.Get(
+				"Last-Modified"); lastModified != "" {
+				return "last-modified", lastModified, nil
+			}
+		}
+	}
+
+	var hash string
+	err := withRetries(opts, "downloading "+file.url, func() error {
+		resp, err := fetchURL(http.MethodGet, file.url, opts)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		h := sha256.New()
+		if _, err = io.Copy(h, resp.Body); err != nil {
+			return err
+		}
+		hash = hex(h)
+		return nil
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	return "sha256", hash, nil
+}
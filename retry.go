@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// retryRandom provides the jitter for the retry delays. It is guarded
+// by retryMutex because tags are pushed concurrently.
+var (
+	retryRandom = rand.New(rand.NewSource(time.Now().UnixNano()))
+	retryMutex  sync.Mutex
+)
+
+// isPermanent tells whether the registry or the server of a remote file
+// rejected the request for a reason that retrying cannot fix, such as
+// missing permissions. Server errors, rate limiting, and network and TLS
+// errors are transient.
+func isPermanent(err error) bool {
+	var transportErr *transport.Error
+	var statusErr *statusError
+	var statusCode int
+	switch {
+	case errors.As(err, &transportErr):
+		statusCode = transportErr.StatusCode
+	case errors.As(err, &statusErr):
+		statusCode = statusErr.statusCode
+	default:
+		return false
+	}
+	return statusCode < http.StatusInternalServerError &&
+		statusCode != http.StatusTooManyRequests
+}
+
+// withRetries calls the function until it succeeds, up to '-retries'
+// more times, doubling the delay between the attempts, starting from
+// '-retry-delay'. Each delay is randomly varied by up to 50% in either
+// direction, so that concurrent runs do not retry in lockstep. Docker
+// commands fail with just an exit code, so all their failures are
+// retried; the operations passed here are idempotent.
+func withRetries(opts *options, operation string, f func() error) error {
+	delay := opts.retryDelay
+
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt > opts.retries || isPermanent(err) {
+			return err
+		}
+
+		retryMutex.Lock()
+		jittered := time.Duration(float64(delay) *
+			(0.5 + retryRandom.Float64()))
+		retryMutex.Unlock()
+
+		fmt.Fprintf(os.Stderr, "Warning: %s failed: %v; retrying "+
+			"in %s (attempt %d of %d)\n", operation, err,
+			jittered.Round(time.Millisecond), attempt+1,
+			opts.retries+1)
+		time.Sleep(jittered)
+		delay *= 2
+	}
+}
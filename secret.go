@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// readBuildSecret parses the '-secret' specification, which has the
+// format of 'docker build --secret': 'id=ID,src=PATH' for a secret file,
+// or 'id=ID,env=VARIABLE' for an environment variable. Without either,
+// the secret is taken from the environment variable named by the ID.
+// The ID and the value of the secret are returned.
+func readBuildSecret(spec string) (string, []byte, error) {
+	var id, src, env string
+	for _, field := range strings.Split(spec, ",") {
+		keyAndValue := strings.SplitN(field, "=", 2)
+		if len(keyAndValue) != 2 {
+			return "", nil, fmt.Errorf("invalid secret spec '%s'",
+				spec)
+		}
+		switch value := keyAndValue[1]; keyAndValue[0] {
+		case "id":
+			id = value
+		case "src", "source":
+			src = value
+		case "env":
+			env = value
+		case "type":
+			if value != "file" && value != "env" {
+				return "", nil, fmt.Errorf("invalid secret "+
+					"type '%s' in '%s'", value, spec)
+			}
+		default:
+			return "", nil, fmt.Errorf("invalid secret spec '%s': "+
+				"unknown key '%s'", spec, keyAndValue[0])
+		}
+	}
+
+	if id == "" {
+		return "", nil, fmt.Errorf("invalid secret spec '%s': "+
+			"missing id", spec)
+	}
+
+	if src != "" {
+		value, err := ioutil.ReadFile(src)
+		if err != nil {
+			return "", nil, fmt.Errorf("secret '%s': %v", id, err)
+		}
+		return id, value, nil
+	}
+
+	if env == "" {
+		env = id
+	}
+	value, ok := os.LookupEnv(env)
+	if !ok {
+		return "", nil, fmt.Errorf("secret '%s': the environment "+
+			"variable %s is not set", id, env)
+	}
+	return id, []byte(value), nil
+}
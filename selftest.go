@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// selfTestRegistryImage is the image of the throwaway registry started
+// by the self-test.
+const selfTestRegistryImage = "registry:2"
+
+// selfTestFiles is the build context of the image built by the self-test.
+var selfTestFiles = map[string]string{
+	"Dockerfile": "FROM scratch\nCOPY hello.txt /\n",
+	"hello.txt":  "Hello from the docker-reuse self-test.\n",
+	"image.txt":  "docker-reuse-selftest\n",
+}
+
+// startSelfTestRegistry starts a registry container listening on a random
+// loopback port and returns the container ID and the registry address.
+func startSelfTestRegistry() (string, string, error) {
+	output, err := dockerCmdOutput("run", "-d", "--rm",
+		"-p", "127.0.0.1::5000", selfTestRegistryImage)
+	if err != nil {
+		return "", "", fmt.Errorf(
+			"unable to start the registry container: %v", err)
+	}
+	containerID := strings.TrimSpace(string(output))
+
+	output, err = dockerCmdOutput("port", containerID, "5000/tcp")
+	if err != nil {
+		stopSelfTestRegistry(containerID)
+		return "", "", err
+	}
+	// Only the first line is relevant if the port is published
+	// on several addresses.
+	address := strings.TrimSpace(
+		strings.SplitN(string(output), "\n", 2)[0])
+
+	// Wait for the registry to start accepting requests.
+	for attempt := 0; ; attempt++ {
+		resp, err := http.Get("http://" + address + "/v2/")
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		if attempt == 30 {
+			stopSelfTestRegistry(containerID)
+			return "", "", fmt.Errorf(
+				"the registry at %s did not start: %v",
+				address, err)
+		}
+		time.Sleep(time.Second)
+	}
+
+	return containerID, address, nil
+}
+
+func stopSelfTestRegistry(containerID string) {
+	if _, err := dockerCmdOutput("rm", "-f", containerID); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: unable to remove "+
+			"the registry container %s: %v\n", containerID, err)
+	}
+}
+
+// runSelfTest builds a tiny image twice against a throwaway local registry
+// and checks that the first run builds and pushes the image, and that the
+// second run reuses it and updates the template file. It verifies that the
+// docker daemon, the registry API access, and the push work in the current
+// environment.
+func runSelfTest(quiet bool) error {
+	dir, err := ioutil.TempDir("", "docker-reuse-selftest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	for filename, contents := range selfTestFiles {
+		if err = ioutil.WriteFile(filepath.Join(dir, filename),
+			[]byte(contents), 0644); err != nil {
+			return err
+		}
+	}
+
+	containerID, address, err := startSelfTestRegistry()
+	if err != nil {
+		return err
+	}
+	defer stopSelfTestRegistry(containerID)
+
+	imageName := address + "/docker-reuse-selftest"
+	templateFilename := filepath.Join(dir, "image.txt")
+
+	// The placeholder is not the image name, which contains
+	// the random port.
+	opts := options{
+		placeholder: "docker-reuse-selftest",
+		format:      "text",
+		mode:        "sha1",
+		urlMode:     "etag",
+		tagsOnReuse: "always",
+		lintMode:    "off",
+		secretArgs:  map[string]bool{},
+		ignoredArgs: map[string]bool{},
+		quiet:       quiet,
+	}
+
+	for run, expected := range []string{"built", "reused"} {
+		if !quiet {
+			fmt.Printf("Self-test run %d of 2\n", run+1)
+		}
+
+		result, err := findOrBuildAndPushImage(dir, imageName,
+			templateFilename, &opts)
+		if err != nil {
+			return fmt.Errorf("self-test run %d failed: %v",
+				run+1, err)
+		}
+		if result.Decision != expected {
+			return fmt.Errorf("self-test run %d: expected the "+
+				"image to be %s, but it was %s", run+1,
+				expected, result.Decision)
+		}
+
+		// The second run looks for the updated reference.
+		opts.placeholder = result.Image
+	}
+
+	contents, err := ioutil.ReadFile(templateFilename)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(contents)) != opts.placeholder {
+		return fmt.Errorf("self-test: '%s' was not updated",
+			templateFilename)
+	}
+
+	fmt.Println("Self-test passed")
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+// skaffoldArtifact is the subset of a Skaffold artifact definition
+// that docker-reuse understands. Only the docker builder, which Skaffold
+// uses by default, is supported; the sections of the other builders are
+// only decoded to detect them.
+type skaffoldArtifact struct {
+	Image   string `yaml:"image"`
+	Context string `yaml:"context"`
+	Docker  struct {
+		Dockerfile string             `yaml:"dockerfile"`
+		BuildArgs  map[string]*string `yaml:"buildArgs"`
+	} `yaml:"docker"`
+	Jib        interface{} `yaml:"jib"`
+	Buildpacks interface{} `yaml:"buildpacks"`
+	Custom     interface{} `yaml:"custom"`
+	Bazel      interface{} `yaml:"bazel"`
+	Ko         interface{} `yaml:"ko"`
+	Kaniko     interface{} `yaml:"kaniko"`
+}
+
+// otherBuilder returns the name of the Skaffold builder other than
+// docker that the artifact uses, or an empty string.
+func (artifact *skaffoldArtifact) otherBuilder() string {
+	for _, builder := range []struct {
+		name    string
+		section interface{}
+	}{
+		{"jib", artifact.Jib},
+		{"buildpacks", artifact.Buildpacks},
+		{"custom", artifact.Custom},
+		{"bazel", artifact.Bazel},
+		{"ko", artifact.Ko},
+		{"kaniko", artifact.Kaniko},
+	} {
+		if builder.section != nil {
+			return builder.name
+		}
+	}
+	return ""
+}
+
+type skaffoldConfig struct {
+	Build struct {
+		Artifacts []skaffoldArtifact `yaml:"artifacts"`
+	} `yaml:"build"`
+}
+
+// loadSkaffoldArtifacts reads the artifacts from all configurations
+// found in a skaffold.yaml file. Artifact contexts are resolved relative
+// to the directory containing the file.
+func loadSkaffoldArtifacts(filename string) ([]skaffoldArtifact, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	baseDir := filepath.Dir(filename)
+
+	var artifacts []skaffoldArtifact
+
+	decoder := yaml.NewDecoder(f)
+	for {
+		var config skaffoldConfig
+		if err = decoder.Decode(&config); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+
+		for _, artifact := range config.Build.Artifacts {
+			artifact.Context = filepath.Join(
+				baseDir, artifact.Context)
+			if artifact.Docker.Dockerfile != "" {
+				artifact.Docker.Dockerfile = filepath.Join(
+					artifact.Context,
+					artifact.Docker.Dockerfile)
+			}
+			artifacts = append(artifacts, artifact)
+		}
+	}
+
+	return artifacts, nil
+}
+
+// buildArgs returns the build arguments of the artifact in the NAME=value
+// format. Arguments without a value are taken from the environment; as
+// with the build arguments given on the command line, those whose
+// variables are not set are dropped, so that the Dockerfile defaults apply.
+func (artifact *skaffoldArtifact) buildArgs() []string {
+	var names []string
+	for name := range artifact.Docker.BuildArgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buildArgs []string
+	for _, name := range names {
+		if value := artifact.Docker.BuildArgs[name]; value != nil {
+			buildArgs = append(buildArgs, name+"="+*value)
+		} else if value, ok := os.LookupEnv(name); ok {
+			buildArgs = append(buildArgs, name+"="+value)
+		}
+	}
+	return buildArgs
+}
+
+type skaffoldBuild struct {
+	ImageName string `json:"imageName"`
+	Tag       string `json:"tag"`
+}
+
+// writeSkaffoldBuildOutput saves the image references in the format
+// accepted by 'skaffold deploy --build-artifacts'.
+func writeSkaffoldBuildOutput(filename string, builds []skaffoldBuild) error {
+	output, err := json.MarshalIndent(struct {
+		Builds []skaffoldBuild `json:"builds"`
+	}{builds}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, append(output, '\n'), 0644)
+}
+
+// findOrBuildSkaffoldArtifacts runs the find-or-build flow for each
+// artifact defined in the Skaffold configuration file.
+func findOrBuildSkaffoldArtifacts(skaffoldFilename, templateFilename,
+	outputFilename string, opts *options) ([]*imageResult, error) {
+
+	all, err := loadSkaffoldArtifacts(skaffoldFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	// The artifacts built by the other builders are left to Skaffold
+	// and are not included in the build output.
+	var artifacts []skaffoldArtifact
+	for _, artifact := range all {
+		if builder := artifact.otherBuilder(); builder != "" {
+			fmt.Fprintf(os.Stderr, "Warning: skipping '%s': "+
+				"the %s builder is not supported\n",
+				artifact.Image, builder)
+			continue
+		}
+		artifacts = append(artifacts, artifact)
+	}
+
+	if len(artifacts) == 0 {
+		return nil, fmt.Errorf("'%s' does not define any artifacts "+
+			"built with docker", skaffoldFilename)
+	}
+
+	if opts.placeholder != "" && len(artifacts) > 1 {
+		return nil, errors.New("a placeholder cannot be used " +
+			"with multiple Skaffold artifacts")
+	}
+
+	var results []*imageResult
+	var builds []skaffoldBuild
+
+	for _, artifact := range artifacts {
+		artifactOpts := *opts
+		artifactOpts.dockerfile = artifact.Docker.Dockerfile
+		artifactOpts.buildArgs = artifact.buildArgs()
+
+		result, err := findOrBuildAndPushImage(artifact.Context,
+			artifact.Image, templateFilename, &artifactOpts)
+		if err != nil {
+			return results, err
+		}
+
+		results = append(results, result)
+		builds = append(builds,
+			skaffoldBuild{artifact.Image, result.Image})
+	}
+
+	if outputFilename == "" {
+		return results, nil
+	}
+
+	return results, writeSkaffoldBuildOutput(outputFilename, builds)
+}
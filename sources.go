@@ -1,47 +1,585 @@
 package main
 
 import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/moby/buildkit/frontend/dockerfile/shell"
 )
 
-func collectSourcesFromDockerfile(f *os.File) ([]string, error) {
-	res, err := parser.Parse(f)
+// stageVars tracks the ARG and ENV variables in scope of a build stage.
+type stageVars struct {
+	args map[string]string
+	env  map[string]string
+}
+
+// lookup returns the variables for expansion. As in docker build,
+// ENV variables take precedence over ARG variables with the same name.
+func (v *stageVars) lookup() map[string]string {
+	vars := map[string]string{}
+	for name, value := range v.args {
+		vars[name] = value
+	}
+	for name, value := range v.env {
+		vars[name] = value
+	}
+	return vars
+}
+
+// remoteFile is a file or a git repository that ADD downloads from a URL.
+type remoteFile struct {
+	url string
+	// checksum is the value of the '--checksum' flag, if any.
+	checksum string
+}
+
+// dockerfileSources holds the sources referenced by a Dockerfile.
+type dockerfileSources struct {
+	// paths lists the build context paths and patterns.
+	paths []string
+	urls  []remoteFile
+	// gitRepos lists the git repositories added by ADD.
+	gitRepos []remoteFile
+	// images lists the external images that COPY --from refers to.
+	images []string
+	// baseImages lists the images named by FROM.
+	baseImages []string
+	// secrets lists the IDs of the secrets mounted by RUN.
+	secrets []string
+	// syntax is the frontend image named by the syntax directive.
+	syntax string
+	// overrides maps the names of the declared ARGs whose values are
+	// given as build arguments to whether any of the values differ
+	// from the defaults.
+	overrides map[string]bool
+}
+
+// isURL tells whether an ADD source is a remote file.
+func isURL(source string) bool {
+	return strings.HasPrefix(source, "http://") ||
+		strings.HasPrefix(source, "https://")
+}
+
+// buildStage holds what is known about a build stage of the Dockerfile.
+type buildStage struct {
+	vars *stageVars
+	// deps lists the indices of the stages this stage depends on.
+	deps    []int
+	sources dockerfileSources
+}
+
+// stageIndex returns the index of the build stage that the value of
+// the '--from' flag or the FROM base image refers to, or -1 if it does
+// not refer to a previous stage.
+func stageIndex(name string, stageNames map[string]int,
+	stageCount int) int {
+
+	if index, ok := stageNames[strings.ToLower(name)]; ok {
+		return index
+	}
+	if index, err := strconv.Atoi(name); err == nil &&
+		index >= 0 && index < stageCount {
+		return index
+	}
+	return -1
+}
+
+// reDirective matches the parser directives at the top of the Dockerfile.
+var reDirective = regexp.MustCompile(
+	`^#\s*([a-zA-Z][a-zA-Z0-9]*)\s*=\s*(.+?)\s*$`)
+
+// detectSyntax returns the value of the syntax parser directive. Like the
+// parser, it only considers the comments that precede everything else.
+func detectSyntax(contents []byte) string {
+	for _, line := range strings.Split(string(contents), "\n") {
+		m := reDirective.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			break
+		}
+		if strings.EqualFold(m[1], "syntax") {
+			return m[2]
+		}
+	}
+	return ""
+}
+
+// parseMount parses the value of the '--mount' flag of a RUN instruction.
+// The aliases of the option names are normalized, and the type defaults
+// to 'bind'.
+func parseMount(value string) (map[string]string, error) {
+	fields, err := csv.NewReader(strings.NewReader(value)).Read()
+	if err != nil {
+		return nil, fmt.Errorf("invalid mount '%s': %v", value, err)
+	}
+
+	mount := map[string]string{"type": "bind"}
+	for _, field := range fields {
+		parts := strings.SplitN(field, "=", 2)
+		key := strings.ToLower(parts[0])
+		switch key {
+		case "src":
+			key = "source"
+		case "dst", "destination":
+			key = "target"
+		}
+		if len(parts) == 2 {
+			mount[key] = parts[1]
+		} else {
+			mount[key] = ""
+		}
+	}
+
+	return mount, nil
+}
+
+// merge appends the sources that have not been seen yet.
+func (s *dockerfileSources) merge(other *dockerfileSources,
+	seen map[string]bool) {
+
+	for _, path := range other.paths {
+		if !seen[path] {
+			s.paths = append(s.paths, path)
+			seen[path] = true
+		}
+	}
+	for _, file := range other.urls {
+		if !seen[file.url] {
+			s.urls = append(s.urls, file)
+			seen[file.url] = true
+		}
+	}
+	for _, repo := range other.gitRepos {
+		if !seen[repo.url] {
+			s.gitRepos = append(s.gitRepos, repo)
+			seen[repo.url] = true
+		}
+	}
+	for _, image := range other.images {
+		if !seen[image] {
+			s.images = append(s.images, image)
+			seen[image] = true
+		}
+	}
+	for _, image := range other.baseImages {
+		if !seen["FROM "+image] {
+			s.baseImages = append(s.baseImages, image)
+			seen["FROM "+image] = true
+		}
+	}
+	for _, id := range other.secrets {
+		if !seen["secret "+id] {
+			s.secrets = append(s.secrets, id)
+			seen["secret "+id] = true
+		}
+	}
+	for name, differs := range other.overrides {
+		s.overrides[name] = s.overrides[name] || differs
+	}
+}
+
+// collectSourcesFromDockerfile returns the COPY and ADD sources of the
+// Dockerfile. Variable references in the sources are expanded using the
+// ARG defaults, the values of the build arguments, and the ENV declarations
+// in scope. Heredoc sources are skipped. Files bind-mounted into RUN
+// instructions from the build context are included, as are the IDs of
+// the mounted secrets. The URLs and git repositories added by ADD and the
+// external images used by COPY --from or RUN --mount, as well as the base
+// images, are returned separately from the build context paths; the named
+// build contexts are not reported as images. If the target stage is given,
+// only the sources of the stages that the target depends on are returned.
+func collectSourcesFromDockerfile(f *os.File,
+	opts *options) (*dockerfileSources, error) {
+
+	contents, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	dockerfile, err := blankHeredocs(bytes.NewReader(contents))
 	if err != nil {
 		return nil, err
 	}
 
-	var sources []string
-	alreadyAdded := map[string]bool{}
+	// The parser handles the escape directive.
+	res, err := parser.Parse(dockerfile)
+	if err != nil {
+		return nil, err
+	}
+
+	// Windows-style Dockerfiles, which change the escape character to
+	// allow backslashes in paths, use them as path separators.
+	toSlash := func(source string) string {
+		if res.EscapeToken == '`' {
+			return strings.ReplaceAll(source, `\`, "/")
+		}
+		return source
+	}
+
+	lex := shell.NewLex(res.EscapeToken)
+
+	argValues := map[string]string{}
+	for _, buildArg := range opts.buildArgs {
+		if eq := strings.IndexByte(buildArg, '='); eq >= 0 {
+			argValues[buildArg[:eq]] = buildArg[eq+1:]
+		}
+	}
+
+	// Defaults of the global ARGs, which the stages can inherit.
+	globalDefaults := map[string]string{}
+
+	// declareArgs processes an ARG instruction. The value passed
+	// on the command line overrides the default. Whether it differs
+	// from the default is recorded in the overrides map.
+	declareArgs := func(node *parser.Node, vars *stageVars,
+		inherited map[string]string, overrides map[string]bool) error {
+		for ; node != nil; node = node.Next {
+			name, value := node.Value, ""
+			hasDefault := false
+			if eq := strings.IndexByte(name, '='); eq >= 0 {
+				name, value = name[:eq], name[eq+1:]
+				hasDefault = true
+			}
+
+			if hasDefault {
+				expanded, err := lex.ProcessWordWithMap(
+					value, vars.lookup())
+				if err != nil {
+					return err
+				}
+				value = expanded
+			} else if global, ok := inherited[name]; ok {
+				value = global
+				hasDefault = true
+			}
+
+			if inherited == nil && hasDefault {
+				globalDefaults[name] = value
+			}
+
+			if override, ok := argValues[name]; ok {
+				overrides[name] = overrides[name] ||
+					!hasDefault || override != value
+				value = override
+			} else if !hasDefault {
+				continue
+			}
+
+			vars.args[name] = value
+		}
+		return nil
+	}
+
+	// Named build contexts are fingerprinted as a whole.
+	namedContexts := map[string]bool{}
+	for _, context := range opts.buildContexts {
+		name, _ := splitBuildContext(context)
+		namedContexts[name] = true
+	}
+
+	global := &stageVars{map[string]string{}, map[string]string{}}
+	globalOverrides := map[string]bool{}
+	var stages []*buildStage
+	stageNames := map[string]int{}
+	var current *buildStage
 
 nextChild:
 	for _, child := range res.AST.Children {
-		if child.Value != "add" && child.Value != "copy" {
+		switch child.Value {
+		case "from":
+			current = &buildStage{vars: &stageVars{
+				map[string]string{}, map[string]string{}},
+				sources: dockerfileSources{
+					overrides: map[string]bool{}}}
+			stages = append(stages, current)
+			if child.Next == nil {
+				continue
+			}
+			base, err := lex.ProcessWordWithMap(
+				child.Next.Value, global.lookup())
+			if err != nil {
+				return nil, err
+			}
+			// A stage based on another stage inherits its
+			// environment.
+			if index := stageIndex(base, stageNames,
+				len(stages)-1); index >= 0 {
+				current.deps = append(current.deps, index)
+				for name, value := range stages[index].vars.env {
+					current.vars.env[name] = value
+				}
+			} else if base != "scratch" && !namedContexts[base] {
+				current.sources.baseImages = append(
+					current.sources.baseImages, base)
+			}
+			if n := child.Next.Next; n != nil &&
+				strings.EqualFold(n.Value, "as") && n.Next != nil {
+				stageNames[strings.ToLower(n.Next.Value)] =
+					len(stages) - 1
+			}
+			continue
+		case "arg":
+			if current == nil {
+				err = declareArgs(child.Next, global, nil,
+					globalOverrides)
+			} else {
+				err = declareArgs(child.Next, current.vars,
+					globalDefaults,
+					current.sources.overrides)
+			}
+			if err != nil {
+				return nil, err
+			}
+			continue
+		case "env":
+			if current == nil {
+				continue
+			}
+			for n := child.Next; n != nil && n.Next != nil; n = n.Next.Next {
+				value, err := lex.ProcessWordWithMap(
+					n.Next.Value, current.vars.lookup())
+				if err != nil {
+					return nil, err
+				}
+				current.vars.env[n.Value] = value
+			}
+			continue
+		case "run":
+			if current == nil {
+				continue
+			}
+			for _, flag := range child.Flags {
+				if !strings.HasPrefix(flag, "--mount=") {
+					continue
+				}
+				mount, err := parseMount(
+					strings.TrimPrefix(flag, "--mount="))
+				if err != nil {
+					return nil, err
+				}
+				vars := current.vars.lookup()
+				// Secrets are provided by the '-secret'
+				// options rather than the build context; the
+				// ID defaults to the name of the target file.
+				if mount["type"] == "secret" {
+					id, err := lex.ProcessWordWithMap(
+						mount["id"], vars)
+					if err != nil {
+						return nil, err
+					}
+					if id == "" {
+						id = path.Base(mount["target"])
+					}
+					current.sources.secrets = append(
+						current.sources.secrets, id)
+					continue
+				}
+				// Cache and tmpfs mounts do not affect the
+				// image contents. SSH agent sockets are
+				// provided by the '-ssh' options.
+				if mount["type"] != "bind" {
+					continue
+				}
+				// Mounts from other stages make this stage
+				// depend on them, like COPY --from.
+				if from, ok := mount["from"]; ok {
+					from, err = lex.ProcessWordWithMap(
+						from, vars)
+					if err != nil {
+						return nil, err
+					}
+					if index := stageIndex(from, stageNames,
+						len(stages)-1); index >= 0 {
+						current.deps = append(
+							current.deps, index)
+					} else if !namedContexts[from] {
+						current.sources.images = append(
+							current.sources.images, from)
+					}
+					continue
+				}
+				source, err := lex.ProcessWordWithMap(
+					mount["source"], vars)
+				if err != nil {
+					return nil, err
+				}
+				if source == "" {
+					source = "."
+				}
+				current.sources.paths = append(
+					current.sources.paths, toSlash(source))
+			}
+			continue
+		case "add", "copy":
+			if current == nil {
+				continue
+			}
+		default:
 			continue
 		}
 
+		vars := current.vars.lookup()
+		sources := &current.sources
+
+		var checksum string
 		for _, flag := range child.Flags {
-			if strings.HasPrefix(flag, "--from") {
+			if strings.HasPrefix(flag, "--from=") {
+				from, err := lex.ProcessWordWithMap(
+					strings.TrimPrefix(flag, "--from="), vars)
+				if err != nil {
+					return nil, err
+				}
+				// Files copied from the previous stages are
+				// covered by the sources of those stages.
+				if index := stageIndex(from, stageNames,
+					len(stages)-1); index >= 0 {
+					current.deps = append(current.deps, index)
+				} else if !namedContexts[from] {
+					sources.images = append(
+						sources.images, from)
+				}
 				continue nextChild
 			}
+			if strings.HasPrefix(flag, "--checksum=") {
+				checksum, err = lex.ProcessWordWithMap(
+					strings.TrimPrefix(flag, "--checksum="),
+					vars)
+				if err != nil {
+					return nil, err
+				}
+			}
 		}
 
 		if child.Next != nil {
 			src := child.Next
 
-			// Stop at the last token, which is <dest>.
-			for src.Next != nil {
-				if !alreadyAdded[src.Value] {
-					sources = append(sources, src.Value)
-					alreadyAdded[src.Value] = true
+			// Stop at the last token, which is <dest>. In the
+			// JSON form, the parser has already unquoted the
+			// elements; like docker build, variables in them are
+			// still expanded.
+			for ; src.Next != nil; src = src.Next {
+				// Heredoc contents are hashed as part
+				// of the Dockerfile.
+				if isHeredocSource(src.Value) {
+					continue
+				}
+
+				source, err := lex.ProcessWordWithMap(
+					src.Value, vars)
+				if err != nil {
+					return nil, err
 				}
 
-				src = src.Next
+				if child.Value == "add" && isGitURL(source) {
+					sources.gitRepos = append(sources.gitRepos,
+						remoteFile{source, checksum})
+				} else if child.Value == "add" && isURL(source) {
+					sources.urls = append(sources.urls,
+						remoteFile{source, checksum})
+				} else {
+					sources.paths = append(
+						sources.paths, toSlash(source))
+				}
 			}
 		}
 	}
 
+	// Without a target, the sources of all stages are returned.
+	target := opts.target
+	reachable := make([]bool, len(stages))
+	if target == "" {
+		for i := range reachable {
+			reachable[i] = true
+		}
+	} else {
+		index, ok := stageNames[strings.ToLower(target)]
+		if !ok {
+			return nil, fmt.Errorf("target stage '%s' not found",
+				target)
+		}
+		var visit func(int)
+		visit = func(i int) {
+			if !reachable[i] {
+				reachable[i] = true
+				for _, dep := range stages[i].deps {
+					visit(dep)
+				}
+			}
+		}
+		visit(index)
+	}
+
+	// The global ARGs can be used in any FROM instruction.
+	sources := &dockerfileSources{syntax: detectSyntax(contents),
+		overrides: globalOverrides}
+	seen := map[string]bool{}
+	for i, stage := range stages {
+		if reachable[i] {
+			sources.merge(&stage.sources, seen)
+		}
+	}
+
 	return sources, nil
 }
+
+// predefinedArgs lists the build arguments that docker build accepts
+// without a matching ARG instruction.
+var predefinedArgs = map[string]bool{
+	"HTTP_PROXY": true, "http_proxy": true,
+	"HTTPS_PROXY": true, "https_proxy": true,
+	"FTP_PROXY": true, "ftp_proxy": true,
+	"NO_PROXY": true, "no_proxy": true,
+	"ALL_PROXY": true, "all_proxy": true,
+}
+
+// checkUndeclaredArgs reports the build arguments that are not declared
+// by the ARG instructions in scope of the build, which usually indicates
+// a typo. The report is a warning unless strict is set, in which case it
+// is an error.
+func checkUndeclaredArgs(buildArgs []string, sources *dockerfileSources,
+	dockerfile string, strict bool) error {
+
+	var undeclared []string
+	for _, buildArg := range buildArgs {
+		name := strings.SplitN(buildArg, "=", 2)[0]
+		if _, declared := sources.overrides[name]; !declared &&
+			!predefinedArgs[name] &&
+			!strings.HasPrefix(name, "BUILDKIT_") {
+			undeclared = append(undeclared, name)
+		}
+	}
+
+	if len(undeclared) == 0 {
+		return nil
+	}
+
+	message := fmt.Sprintf("build arguments not declared in '%s': %s",
+		dockerfile, strings.Join(undeclared, ", "))
+	if strict {
+		return errors.New(message)
+	}
+	fmt.Fprintf(os.Stderr, "Warning: %s\n", message)
+	return nil
+}
+
+// dockerImagePrefix starts the named build context values that refer
+// to an image.
+const dockerImagePrefix = "docker-image://"
+
+// splitBuildContext splits the value of the '-build-context' option
+// into the context name and its location.
+func splitBuildContext(context string) (string, string) {
+	parts := strings.SplitN(context, "=", 2)
+	if len(parts) != 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
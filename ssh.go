@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// sshIDs returns the sorted mount IDs declared by the '-ssh'
+// specifications, so that the order of the options does not matter.
+// Only the IDs take part in the fingerprint: the keys themselves are
+// credentials and do not affect the contents of the image.
+func sshIDs(specs []string) []string {
+	var ids []string
+	for _, spec := range specs {
+		ids = append(ids, strings.SplitN(spec, "=", 2)[0])
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// checkSSHSpecs verifies that the agent socket or the keys referenced by
+// the '-ssh' specifications are available before starting the build.
+func checkSSHSpecs(specs []string) error {
+	for _, spec := range specs {
+		idAndPaths := strings.SplitN(spec, "=", 2)
+
+		if idAndPaths[0] == "" {
+			return fmt.Errorf("invalid SSH spec '%s': "+
+				"missing mount ID", spec)
+		}
+
+		if len(idAndPaths) == 1 {
+			if os.Getenv("SSH_AUTH_SOCK") == "" {
+				return fmt.Errorf("SSH_AUTH_SOCK is not set; "+
+					"start ssh-agent or provide key paths "+
+					"for the SSH mount ID '%s'",
+					idAndPaths[0])
+			}
+			continue
+		}
+
+		for _, pathname := range strings.Split(idAndPaths[1], ",") {
+			if _, err := os.Stat(pathname); err != nil {
+				return fmt.Errorf("SSH mount ID '%s': %v",
+					idAndPaths[0], err)
+			}
+		}
+	}
+	return nil
+}
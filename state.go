@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// maxStateImages is the number of images and repositories whose records
+// are kept in the state file; the least recently used ones are dropped.
+const maxStateImages = 1000
+
+// stateLockTimeout is how long a run waits for the concurrent runs to
+// update the state file. A lock file older than that is considered to be
+// left behind by a run that was killed.
+const stateLockTimeout = 10 * time.Second
+
+// reuseStats holds the cumulative statistics of docker-reuse runs.
+type reuseStats struct {
+	Runs   int `json:"runs"`
+	Reused int `json:"reused"`
+	Built  int `json:"built"`
+	// BuildSeconds is the total time spent building images.
+	BuildSeconds float64 `json:"buildSeconds"`
+}
+
+// buildRecord describes an image built on this machine.
+type buildRecord struct {
+	// Seconds is the build time, for the images that have no duration
+	// label.
+	Seconds float64 `json:"seconds"`
+	// Pushed is the time the image was pushed, from which the TTL
+	// of an ephemeral image counts.
+	Pushed time.Time `json:"pushed"`
+}
+
+// state is the information that docker-reuse keeps between runs.
+type state struct {
+	Stats reuseStats `json:"stats"`
+	// Digests maps the images built or first reused on this machine
+	// to their manifest digests, which '-verify-reuse' checks.
+	Digests map[string]string `json:"digests,omitempty"`
+	// Latest maps the repositories to the images last built or reused
+	// on this machine, which are the build cache of the next build.
+	Latest map[string]string `json:"latest,omitempty"`
+	// Builds describes the images built on this machine.
+	Builds map[string]buildRecord `json:"builds,omitempty"`
+	// Used maps the images in Digests and Latest to the time they were
+	// last built or reused, by which the old records are pruned.
+	Used map[string]time.Time `json:"used,omitempty"`
+}
+
+// defaultStateFile returns the pathname of the state file in the user's
+// cache directory or an empty string if there is no such directory.
+func defaultStateFile() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "docker-reuse", "state.json")
+}
+
+// loadState reads the state file. A missing file yields an empty state.
+func loadState(filename string) (*state, error) {
+	s := &state{}
+
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+
+	if err = json.Unmarshal(contents, s); err != nil {
+		return nil, fmt.Errorf("'%s': %v", filename, err)
+	}
+
+	return s, nil
+}
+
+// save atomically replaces the state file.
+func (s *state) save(filename string) error {
+	contents, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), ".state-*")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(append(contents, '\n'))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// lockStateFile serializes the updates of the state file by concurrent
+// runs using a lock file next to it, which is created exclusively. The
+// returned function releases the lock. The lock is advisory: a run that
+// takes over an abandoned lock file can race with another one doing the
+// same, which only risks losing the update of a single run.
+func lockStateFile(filename string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return nil, err
+	}
+
+	lockName := filename + ".lock"
+	deadline := time.Now().Add(stateLockTimeout)
+	for {
+		f, err := os.OpenFile(lockName,
+			os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(lockName) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if info, err := os.Stat(lockName); err == nil &&
+			time.Since(info.ModTime()) > stateLockTimeout {
+			os.Remove(lockName)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for '%s'",
+				lockName)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// prune drops the records of the least recently used images and
+// repositories beyond maxStateImages. The records that predate the
+// tracking of the usage times go first.
+func (s *state) prune() {
+	byAge := func(images []string) {
+		sort.Slice(images, func(i, j int) bool {
+			return s.Used[images[i]].Before(s.Used[images[j]])
+		})
+	}
+
+	if len(s.Digests) > maxStateImages {
+		var images []string
+		for image := range s.Digests {
+			images = append(images, image)
+		}
+		byAge(images)
+		for _, image := range images[:len(images)-maxStateImages] {
+			delete(s.Digests, image)
+		}
+	}
+
+	if len(s.Builds) > maxStateImages {
+		var images []string
+		for image := range s.Builds {
+			images = append(images, image)
+		}
+		byAge(images)
+		for _, image := range images[:len(images)-maxStateImages] {
+			delete(s.Builds, image)
+		}
+	}
+
+	if len(s.Latest) > maxStateImages {
+		var images []string
+		repositories := map[string]string{}
+		for repository, image := range s.Latest {
+			images = append(images, image)
+			repositories[image] = repository
+		}
+		byAge(images)
+		for _, image := range images[:len(images)-maxStateImages] {
+			delete(s.Latest, repositories[image])
+		}
+	}
+
+	for image := range s.Used {
+		_, hasDigest := s.Digests[image]
+		_, hasBuild := s.Builds[image]
+		if !hasDigest && !hasBuild &&
+			s.Latest[repositoryName(image)] != image {
+			delete(s.Used, image)
+		}
+	}
+}
+
+// recordRun updates the statistics with the outcome of a run. The
+// concurrent runs take turns to update the state file.
+func recordRun(filename string, results []*imageResult) error {
+	unlock, err := lockStateFile(filename)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	s, err := loadState(filename)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+
+	s.Stats.Runs++
+	for _, result := range results {
+		switch result.Decision {
+		case "reused":
+			s.Stats.Reused++
+		case "built":
+			s.Stats.Built++
+			s.Stats.BuildSeconds += result.BuildSeconds
+			if s.Builds == nil {
+				s.Builds = map[string]buildRecord{}
+			}
+			s.Builds[result.Image] = buildRecord{
+				Seconds: result.BuildSeconds, Pushed: now}
+		}
+
+		if s.Latest == nil {
+			s.Latest = map[string]string{}
+		}
+		s.Latest[repositoryName(result.Image)] = result.Image
+		if s.Used == nil {
+			s.Used = map[string]time.Time{}
+		}
+		s.Used[result.Image] = now
+
+		// A rebuilt image replaces the recorded digest.
+		if result.Digest == "" {
+			continue
+		}
+		if s.Digests == nil {
+			s.Digests = map[string]string{}
+		}
+		if _, ok := s.Digests[result.Image]; !ok ||
+			result.Decision == "built" {
+			s.Digests[result.Image] = result.Digest
+		}
+	}
+
+	s.prune()
+	return s.save(filename)
+}
+
+// printStats writes the statistics in the requested format: either
+// 'text' or 'json'.
+func printStats(w io.Writer, filename, format string) error {
+	s, err := loadState(filename)
+	if err != nil {
+		return err
+	}
+
+	stats := s.Stats
+
+	// Estimate the time saved by assuming that each reused image
+	// would have taken the average build time to rebuild.
+	var saved time.Duration
+	if stats.Built != 0 {
+		saved = time.Duration(stats.BuildSeconds /
+			float64(stats.Built) * float64(stats.Reused) *
+			float64(time.Second))
+	}
+
+	switch format {
+	case "json":
+		output, err := json.MarshalIndent(struct {
+			reuseStats
+			SavedSeconds float64 `json:"savedSeconds"`
+		}{stats, saved.Seconds()}, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", output)
+		return err
+	case "text":
+		var reuseRate float64
+		if total := stats.Reused + stats.Built; total != 0 {
+			reuseRate = float64(stats.Reused) / float64(total) * 100
+		}
+		_, err = fmt.Fprintf(w, "Runs: %d\nReused: %d\nBuilt: %d\n"+
+			"Reuse rate: %.1f%%\nTime spent building: %s\n"+
+			"Estimated time saved: %s\n",
+			stats.Runs, stats.Reused, stats.Built, reuseRate,
+			time.Duration(stats.BuildSeconds*float64(time.Second)).
+				Round(time.Second),
+			saved.Round(time.Second))
+		return err
+	}
+
+	return fmt.Errorf("unknown stats format '%s'", format)
+}
+
+// recordedBuild returns what the state file records about the image if
+// it was built on this machine.
+func recordedBuild(imageName string, opts *options) (buildRecord, bool) {
+	if opts.stateFile == "" {
+		return buildRecord{}, false
+	}
+	s, err := loadState(opts.stateFile)
+	if err != nil {
+		return buildRecord{}, false
+	}
+	build, ok := s.Builds[imageName]
+	return build, ok
+}
+
+// previousImage returns the image last built or reused on this machine in
+// the repository of the image, which is used as the build cache when the
+// fingerprint changes, or an empty string if there is no such image.
+func previousImage(imageName string, opts *options) string {
+	if opts.stateFile == "" {
+		return ""
+	}
+	s, err := loadState(opts.stateFile)
+	if err != nil {
+		return ""
+	}
+	if previous := s.Latest[repositoryName(imageName)]; previous !=
+		imageName {
+		return previous
+	}
+	return ""
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// reInvalidTagChars matches the characters that cannot appear in a tag.
+var reInvalidTagChars = regexp.MustCompile(`[^-.\w]`)
+
+// sanitizeTag turns an arbitrary string, such as a branch name, into a
+// valid image tag: every character other than a letter, a digit, an
+// underscore, a period, or a dash is replaced with a dash, the leading
+// periods and dashes are removed, and the result is truncated to 128
+// characters. An empty string is returned if nothing is left.
+func sanitizeTag(tag string) string {
+	tag = strings.TrimLeft(reInvalidTagChars.ReplaceAllString(tag, "-"),
+		".-")
+	if len(tag) > 128 {
+		tag = tag[:128]
+	}
+	return tag
+}
+
+// imageRevisions looks up the revision tags ('IMAGE-r1', 'IMAGE-r2', ...)
+// that '-force-rebuild' pushes with '-immutable-tags'. It returns the name
+// of the latest revision, which is the image name itself if there are no
+// revisions, and the name of the first unused one. Revisions are numbered
+// consecutively, so the search stops at the first missing one.
+func imageRevisions(imageName string, opts *options) (string, string,
+	error) {
+
+	latest := imageName
+	for revision := 1; ; revision++ {
+		revisionName := fmt.Sprintf("%s-r%d", imageName, revision)
+		found, err := imageExists(revisionName, opts)
+		if err != nil {
+			return "", "", err
+		}
+		if !found {
+			return latest, revisionName, nil
+		}
+		latest = revisionName
+	}
+}
+
+// checkTagsOnReuse validates the value of the '-tags-on-reuse' option.
+func checkTagsOnReuse(policy string) error {
+	switch policy {
+	case "never", "always", "if-missing":
+		return nil
+	}
+	return errors.New("-tags-on-reuse must be one of " +
+		"'never', 'always', or 'if-missing'")
+}
+
+// checkTagMove decides whether an existing tag can be moved to the image.
+// It returns false if the tag already points to the image. Moving a tag
+// away from an image with a different fingerprint requires '-force-tag-move'.
+// If the image is pending, that is, yet to be built, the tag cannot point
+// to it.
+func checkTagMove(taggedName, imageName, fingerprint string, pending bool,
+	opts *options) (bool, error) {
+
+	oldDigest, err := getImageDigest(taggedName, opts)
+	if err != nil {
+		return false, err
+	}
+
+	newDigest := "the image being built"
+	if !pending {
+		if newDigest, err = getImageDigest(imageName, opts); err != nil {
+			return false, err
+		}
+		if oldDigest == newDigest {
+			return false, nil
+		}
+	}
+
+	labels, err := getImageLabels(taggedName, opts)
+	if err != nil {
+		return false, err
+	}
+
+	oldFingerprint := labels[fingerprintLabel]
+	if oldFingerprint == fingerprint || opts.forceTagMove {
+		return true, nil
+	}
+
+	if oldFingerprint == "" {
+		oldFingerprint = "unknown"
+	}
+
+	return false, fmt.Errorf("refusing to move tag '%s' from %s "+
+		"(fingerprint %s) to %s (fingerprint %s); "+
+		"use -force-tag-move to override", taggedName,
+		oldDigest, oldFingerprint, newDigest, fingerprint)
+}
+
+// buildxAvailable tells whether the docker buildx plugin is installed.
+// The other build tools have no buildx.
+func buildxAvailable() bool {
+	return buildTool == "docker" &&
+		exec.Command("docker", "buildx", "version").Run() == nil
+}
+
+// buildxArgs returns the arguments of the buildx command, which runs on
+// the builder instance selected with '-buildx-builder', if any.
+func buildxArgs(opts *options, arg ...string) []string {
+	args := []string{"buildx"}
+	if opts.buildxBuilder != "" {
+		args = append(args, "--builder", opts.buildxBuilder)
+	}
+	return append(args, arg...)
+}
+
+// selectTags returns the names of the additional tags to be pointed at
+// the image with the fingerprint tag, subject to the '-tags-on-reuse'
+// policy for reused images and to the checks of checkTagMove. A pending
+// image is yet to be built, with the tags pushed along with it.
+func selectTags(imageName, fingerprint string, built, pending bool,
+	opts *options) ([]string, error) {
+
+	repository := repositoryName(imageName)
+
+	var taggedNames []string
+
+	for _, tag := range opts.tags {
+		taggedName := repository + ":" + tag
+
+		if !built && opts.tagsOnReuse == "never" {
+			continue
+		}
+
+		exists, err := imageExists(taggedName, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		if exists {
+			if !built && opts.tagsOnReuse == "if-missing" {
+				if !opts.quiet {
+					fmt.Println("Tag already exists:",
+						taggedName)
+				}
+				continue
+			}
+
+			move, err := checkTagMove(taggedName, imageName,
+				fingerprint, pending, opts)
+			if err != nil {
+				return nil, err
+			}
+			if !move {
+				continue
+			}
+		}
+
+		taggedNames = append(taggedNames, taggedName)
+	}
+
+	return taggedNames, nil
+}
+
+// applyAdditionalTags points the additional tags at the image with the
+// fingerprint tag. The tags are created directly in the registry in a
+// single 'docker buildx imagetools create' invocation, which avoids
+// pushing the image again for each tag. If buildx is not available, the
+// image is tagged locally instead (after pulling it if it was reused), and
+// the tags are pushed in parallel. The names of the applied tags are
+// returned.
+func applyAdditionalTags(imageName, fingerprint string, built bool,
+	opts *options) ([]string, error) {
+
+	taggedNames, err := selectTags(imageName, fingerprint, built, false,
+		opts)
+	if err != nil || len(taggedNames) == 0 {
+		return nil, err
+	}
+
+	if buildxAvailable() {
+		args := buildxArgs(opts, "imagetools", "create")
+		for _, taggedName := range taggedNames {
+			args = append(args, "-t", taggedName)
+		}
+		args = append(args, imageName)
+		return taggedNames, withRetries(opts, "tagging "+imageName,
+			func() error {
+				return runDockerCmd(opts.quiet, args...)
+			})
+	}
+
+	// A reused image has to be pulled to be tagged locally.
+	if !built {
+		if err := runDockerCmd(opts.quiet,
+			"pull", imageName); err != nil {
+			return nil, err
+		}
+	}
+
+	// All tags are applied and verified locally before anything is
+	// pushed, so an interrupted run does not leave the registry with
+	// only some of the tags pushed because tagging failed midway.
+	// Since the tags that already point to the image in the registry
+	// are skipped above, rerunning converges to the same state.
+	for _, taggedName := range taggedNames {
+		if err := runDockerCmd(opts.quiet,
+			"tag", imageName, taggedName); err != nil {
+			return nil, err
+		}
+	}
+	if err := verifyLocalTags(imageName, taggedNames); err != nil {
+		return nil, err
+	}
+
+	return taggedNames, pushTags(taggedNames, opts)
+}
+
+// localImageID returns the ID of the local image.
+func localImageID(imageName string) (string, error) {
+	output, err := dockerCmdOutput("image", "inspect",
+		"--format", "{{.Id}}", imageName)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// verifyLocalTags checks that the local tags point to the image.
+func verifyLocalTags(imageName string, taggedNames []string) error {
+	id, err := localImageID(imageName)
+	if err != nil {
+		return err
+	}
+
+	for _, taggedName := range taggedNames {
+		taggedID, err := localImageID(taggedName)
+		if err != nil {
+			return err
+		}
+		if taggedID != id {
+			return fmt.Errorf("local tag '%s' points to %s "+
+				"instead of %s", taggedName, taggedID, id)
+		}
+	}
+
+	return nil
+}
+
+// pushTags pushes the tagged images concurrently. The tags share the
+// layers that have already been pushed with the fingerprint tag, so each
+// push mostly amounts to uploading the manifest. The output of each push
+// is printed when it completes. All pushes are attempted even if some of
+// them fail.
+func pushTags(taggedNames []string, opts *options) error {
+	errs := make([]error, len(taggedNames))
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+
+	for i, taggedName := range taggedNames {
+		wg.Add(1)
+		go func(i int, taggedName string) {
+			defer wg.Done()
+
+			var output []byte
+			err := withRetries(opts, "pushing "+taggedName,
+				func() (err error) {
+					cmd := exec.Command(buildTool,
+						"push", "-q", taggedName)
+					output, err = cmd.CombinedOutput()
+					return
+				})
+
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			if err != nil {
+				errs[i] = fmt.Errorf("unable to push '%s': %v",
+					taggedName, err)
+				os.Stderr.Write(output)
+				fmt.Fprintln(os.Stderr, "Push failed:", taggedName)
+			} else if !opts.quiet {
+				fmt.Println("Pushed:", taggedName)
+			}
+		}(i, taggedName)
+	}
+
+	wg.Wait()
+
+	var messages []string
+	for _, err := range errs {
+		if err != nil {
+			messages = append(messages, err.Error())
+		}
+	}
+
+	switch len(messages) {
+	case 0:
+		return nil
+	case 1:
+		return errors.New(messages[0])
+	}
+	return fmt.Errorf("%d of %d tags failed to push: %s", len(messages),
+		len(taggedNames), strings.Join(messages, "; "))
+}
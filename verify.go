@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// checkVerifyReuse validates the value of the '-verify-reuse' option.
+func checkVerifyReuse(policy string) error {
+	switch policy {
+	case "", "error", "rebuild":
+		return nil
+	}
+	return errors.New("-verify-reuse must be " +
+		"either 'error' or 'rebuild'")
+}
+
+// verifyReusedImage checks that the image found under the fingerprint tag
+// is the one that was pushed there: its fingerprint label must match the
+// fingerprint, and its digest must match the digest recorded in the state
+// file when the image was built or first reused on this machine. An empty
+// string is returned if the image passes the checks; otherwise, the reason
+// of the mismatch is returned.
+func verifyReusedImage(imageName, fingerprint string,
+	opts *options) (string, error) {
+
+	labels, err := getImageLabels(imageName, opts)
+	if err != nil {
+		return "", err
+	}
+	if label := labels[fingerprintLabel]; label != fingerprint {
+		if label == "" {
+			label = "missing"
+		}
+		return fmt.Sprintf("the fingerprint label is %s", label), nil
+	}
+
+	if opts.stateFile == "" {
+		return "", nil
+	}
+	s, err := loadState(opts.stateFile)
+	if err != nil {
+		return "", err
+	}
+	recorded := s.Digests[imageName]
+	if recorded == "" {
+		return "", nil
+	}
+
+	digest, err := getImageDigest(imageName, opts)
+	if err != nil {
+		return "", err
+	}
+	if digest != recorded {
+		return fmt.Sprintf("the digest is %s instead of %s",
+			digest, recorded), nil
+	}
+	return "", nil
+}
+
+// checkReusedImage applies the '-verify-reuse' policy to the existing
+// image and tells whether it can be reused.
+func checkReusedImage(imageName, fingerprint string,
+	opts *options) (bool, error) {
+
+	mismatch, err := verifyReusedImage(imageName, fingerprint, opts)
+	if err != nil || mismatch == "" {
+		return err == nil, err
+	}
+
+	if opts.verifyReuse == "error" {
+		return false, fmt.Errorf("'%s' has been replaced: %s; use "+
+			"-verify-reuse rebuild to rebuild it", imageName, mismatch)
+	}
+	fmt.Fprintf(os.Stderr, "Warning: '%s' has been replaced: %s; "+
+		"rebuilding\n", imageName, mismatch)
+	return false, nil
+}